@@ -23,39 +23,208 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/yukiarrr/ecsk/pkg/store"
 )
 
-func main() {
-	fromLocal := os.Args[1] == "1"
-	bucket := os.Args[2]
-	key := os.Args[3]
-	path := os.Args[4]
+// multiFlag is the flag which can be specified multiple times.
+type multiFlag []string
+
+func (p *multiFlag) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *multiFlag) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
 
+func main() {
 	ctx := context.Background()
-	cfg, err := store.NewConfig(ctx, "", "", "")
+
+	var include, exclude, headers multiFlag
+	var bucketOpts store.BucketOptions
+	archive := flag.Bool("a", false, "Archive mode (restore the owners of the files)")
+	compress := flag.String("compress", "", "Compress the tar archive with the format")
+	resume := flag.Bool("resume", false, "Resume the upload of the previous run")
+	flag.Var(&include, "include", "Transfer only the files matching the pattern")
+	flag.Var(&exclude, "exclude", "Don't transfer the files matching the pattern")
+	flag.StringVar(&bucketOpts.SSE, "sse", "", "Server-side encryption of the uploaded objects")
+	flag.StringVar(&bucketOpts.SSEKMSKeyID, "sse-kms-key-id", "", "KMS key of the server-side encryption")
+	flag.StringVar(&bucketOpts.ExpectedBucketOwner, "expected-bucket-owner", "", "Account ID of the expected bucket owner")
+	flag.Var(&headers, "header", `Header sent with the presigned URL as "Name: value"`)
+	flag.Parse()
+	args := flag.Args()
+
+	err := validateArgs(args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(2)
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
+	filter, err := store.NewFilter(include, exclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	if fromLocal {
-		_, err := store.Download(ctx, s3Client, bucket, key, path)
+	// Modes which require no AWS credentials in the container.
+	switch args[0] {
+	case "list":
+		err := store.DryRun(args[1], filter)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-	} else {
-		_, err := store.Upload(ctx, s3Client, bucket, key, path)
+		return
+	case "manifest":
+		err := printManifest(args[1], filter)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		return
+	case "get":
+		url, err := readURL(os.Stdin)
+		if err == nil {
+			err = store.GetArchive(ctx, url, parseHeaders(headers), args[1], *archive, filter)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	case "put":
+		url, err := readURL(os.Stdin)
+		if err == nil {
+			err = store.PutArchive(ctx, url, parseHeaders(headers), args[1], filter, *compress)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	mode := args[0]
+	bucket := args[1]
+	key := args[2]
+	path := args[3]
+
+	cfg, err := store.NewConfig(ctx, "", "", "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	s3Client := s3.NewFromConfig(cfg, store.WithBucketOptions(bucketOpts))
+
+	switch mode {
+	case "1":
+		_, err = store.Download(ctx, s3Client, bucket, key, path, filter)
+	case "0":
+		_, err = store.Upload(ctx, s3Client, bucket, key, path, filter, *resume)
+	case "unpack":
+		err = store.DownloadArchive(ctx, s3Client, bucket, key, path, *archive, filter)
+	case "pack":
+		err = store.UploadArchive(ctx, s3Client, bucket, key, path, filter, *compress)
+	case "sync":
+		err = store.Sync(ctx, s3Client, bucket, key, path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// modeArgs is the number of the arguments of each mode, including the mode.
+var modeArgs = map[string]int{
+	"list":     2,
+	"manifest": 2,
+	"get":      2,
+	"put":      2,
+	"1":        4,
+	"0":        4,
+	"unpack":   4,
+	"pack":     4,
+	"sync":     4,
+}
+
+const usage = `Usage:
+  cp [flags] list|manifest <path>
+  cp [flags] get|put <path> (the presigned URL is read from stdin in base64)
+  cp [flags] 0|1|pack|unpack|sync <bucket> <key> <path>`
+
+func validateArgs(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Need mode.\n%s", usage)
+	}
+	n, ok := modeArgs[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown mode: %s\n%s", args[0], usage)
+	}
+	if len(args) != n {
+		return fmt.Errorf("Wrong number of arguments for %s.\n%s", args[0], usage)
+	}
+	return nil
+}
+
+// printManifest prints the manifest of the directory as JSON in base64 between the markers, which ecsk reads through the terminal.
+// The markers and the encoding are the same as the ones of "ecsk cp --via exec", so that the terminal doesn't change the JSON.
+func printManifest(dir string, filter *store.Filter) error {
+	// The directory is created on syncing.
+	m := store.Manifest{}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		m, err = store.NewManifest(dir, filter, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fmt.Println("ecsk-begin")
+	s := base64.StdEncoding.EncodeToString(b)
+	for len(s) > 76 {
+		fmt.Println(s[:76])
+		s = s[76:]
+	}
+	fmt.Printf("%s\necsk-end\n", s)
+
+	return nil
+}
+
+// readURL reads the presigned URL sent by ecsk in base64 until EOF of the terminal.
+func readURL(r io.Reader) (string, error) {
+	b, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimSpace(string(b))
+	if url == "" {
+		return "", errors.New("Need the presigned URL from stdin.")
+	}
+	return url, nil
+}
+
+func parseHeaders(headers []string) http.Header {
+	h := http.Header{}
+	for _, s := range headers {
+		k, v, _ := strings.Cut(s, ":")
+		h.Add(strings.TrimSpace(k), strings.TrimSpace(v))
 	}
+	return h
 }
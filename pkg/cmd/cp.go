@@ -22,44 +22,72 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	ecsTypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/spf13/cobra"
+	"github.com/yukiarrr/ecsk/pkg/helper"
 	"github.com/yukiarrr/ecsk/pkg/store"
 	"github.com/yukiarrr/ecsk/pkg/ui"
 	"github.com/yukiarrr/ecsk/pkg/util"
 )
 
 type CpCommandOptions struct {
-	Cluster    string
-	Task       string
-	Container  string
-	Bucket     string
-	Src        string
-	Dst        string
-	FromLocal  bool
-	FromRemote bool
-	Plugin     string
-	Command    string
-	Region     string
-	Profile    string
+	Cluster        string
+	Service        string
+	Task           string
+	Container      string
+	DstTask        string
+	DstContainer   string
+	Bucket         string
+	Src            string
+	Dst            string
+	FromLocal      bool
+	FromRemote     bool
+	RemoteToRemote bool
+	RemoteToS3     bool
+	S3ToRemote     bool
+	FromStdin      bool
+	ToStdout       bool
+	Stdout         io.Writer
+	S3Key          string
+	Via            string
+	Presign        bool
+	Archive        bool
+	Compress       string
+	Include        []string
+	Exclude        []string
+	DryRun         bool
+	Resume         bool
+	SetupBucket    bool
+	Gc             bool
+	OlderThan      time.Duration
+	SSE            string
+	SSEKMSKeyID    string
+	BucketOwner    string
+	Plugin         string
+	Command        string
+	Region         string
+	Profile        string
 }
 
-const Format = "sh -c 'type curl > /dev/null 2>&1 && curl -s %s -o %s || wget -q -O %[2]s %[1]s; chmod +x ./%[2]s && ./%[2]s %d %s %s %s && rm -f ./%[2]s'"
-
-var DownloadUrl = fmt.Sprintf("https://raw.githubusercontent.com/yukiarrr/ecsk/%s/bin/cp", Version)
-var DownloadUrlForArm64 = fmt.Sprintf("https://raw.githubusercontent.com/yukiarrr/ecsk/%s/bin/cp_arm64", Version)
-
 func init() {
 	var opts CpCommandOptions
 
@@ -76,7 +104,74 @@ If you want to select the container interactively, use "ecsk cp ./ :/etc/nginx/"
 
 # ecsk cp [container_name]:/var/log/nginx/access.log ./
 
-Transfer files from remote to local.`,
+Transfer files from remote to local.
+
+
+# ecsk cp [container_name]:/var/lib/dump.sql - | gzip > dump.tar.gz
+
+Use "-" as the local path to write a tar archive to stdout, or to read a tar archive from stdin like "tar c . | ecsk cp - [container_name]:/srv/".
+Compressed archives from stdin are also accepted.
+
+
+# ecsk cp [task_id]/[container_name]:/etc/nginx/conf.d/ [task_id]/[container_name]:/etc/nginx/conf.d/
+
+Transfer files between containers through the S3 Bucket, without downloading them to local.
+The task can also be specified before the container name in the other forms.
+If the task or the container is omitted, select it interactively.
+
+
+# ecsk cp [container_name]:/var/log/nginx/ s3://[bucket_name]/[prefix]/
+
+Transfer files from the container to the S3 location directly. The objects are not deleted after the transfer.
+Specifying the S3 location as the source, transfer files from S3 to the container.
+
+
+# ecsk cp --exclude node_modules --exclude .git ./ [container_name]:/app/
+
+Select the files to transfer with gitignore-style patterns. "--include" transfers only the matching files.
+Wildcards can also be used in the source path like "[container_name]:'/var/log/*.log'".
+Use "--dry-run" to list the files which would be transferred.
+
+
+# ecsk cp --compress zstd [container_name]:/var/log/app/ ./
+
+Transfer files as a single tar archive compressed with gzip or zstd, which is decompressed automatically on the receiving side.
+
+
+# ecsk cp -a ./ [container_name]:/etc/nginx/
+
+Transfer files as a tar archive, and also restore the owners of the files like "docker cp -a".
+File modes, modification times, symbolic links and empty directories are preserved in the tar archive.
+
+
+# ecsk cp --presign ./ [container_name]:/etc/nginx/
+
+Transfer files as a tar archive with presigned URLs generated locally, so the task role needs no S3 permissions.
+
+
+# ecsk cp --via exec ./ [container_name]:/etc/nginx/
+
+Transfer files as a tar archive over the ECS Exec session without an S3 Bucket.
+tar and base64 commands are required in the container. Since the archive is encoded through the terminal, it is suitable for small files.
+
+
+# ecsk cp --sse aws:kms --sse-kms-key-id [key_id] ./ [container_name]:/etc/nginx/
+
+Upload the objects with the server-side encryption, for the bucket policies which deny unencrypted uploads.
+"--expected-bucket-owner" is sent with every request to the bucket to verify the owner.
+
+
+# ecsk cp --setup-bucket --bucket [bucket_name]
+
+Create the bucket for file transfer if it doesn't exist, and harden it.
+Public access is blocked, default encryption is enabled, and a lifecycle rule expires the objects of transfers after a day.
+It can also be specified with the transfer.
+
+
+# ecsk cp --gc --bucket [bucket_name]
+
+Delete the objects and the incomplete multipart uploads left in the bucket by failed transfers older than "--older-than".
+The failed transfers can't be resumed after they are deleted. With "--dry-run", only list them.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			ctx, cancel := context.WithCancel(context.Background())
 			util.HandleSignals(cancel)
@@ -103,46 +198,152 @@ Transfer files from remote to local.`,
 				os.Exit(1)
 			}
 
+			err = opts.bucketOptions().Validate()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
 			ecsClient := ecs.NewFromConfig(cfg)
-			s3Client := s3.NewFromConfig(cfg)
+			s3Client := s3.NewFromConfig(cfg, store.WithBucketOptions(opts.bucketOptions()))
 			opts.Region = cfg.Region
 			opts.Profile = profile
 
+			if opts.SetupBucket && len(args) == 0 {
+				err = setupCpBucket(ctx, s3Client, opts)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				return
+			}
+			if opts.Gc {
+				if len(args) != 0 {
+					fmt.Fprintln(os.Stderr, `--gc doesn't take the paths. Try "ecsk cp --help".`)
+					os.Exit(1)
+				}
+				err = startCpGc(ctx, s3Client, opts)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				return
+			}
 			if len(args) != 2 {
 				fmt.Fprintln(os.Stderr, `Wrong format. Try "ecsk cp --help".`)
 				os.Exit(1)
 			}
+			if opts.Via != "s3" && opts.Via != "exec" {
+				fmt.Fprintln(os.Stderr, `--via must be "s3" or "exec". Try "ecsk cp --help".`)
+				os.Exit(1)
+			}
 
-			src := strings.Split(args[0], ":")
-			dst := strings.Split(args[1], ":")
-			if len(src) > 1 {
-				opts.FromRemote = true
-				if src[0] != "" {
-					opts.Container = src[0]
+			src := parseCpPath(args[0])
+			dst := parseCpPath(args[1])
+			if (src.remote && !filepath.IsAbs(src.path)) || (dst.remote && !filepath.IsAbs(dst.path)) {
+				fmt.Fprintln(os.Stderr, `The remote path must be absolute. Try "ecsk cp --help".`)
+				os.Exit(1)
+			}
+			if src.s3 || dst.s3 {
+				var s3Path, remotePath cpPath
+				if src.s3 && dst.remote {
+					opts.S3ToRemote = true
+					s3Path, remotePath = src, dst
+				} else if src.remote && dst.s3 {
+					opts.RemoteToS3 = true
+					s3Path, remotePath = dst, src
+				} else {
+					fmt.Fprintln(os.Stderr, `S3 locations can only be copied from or to containers. Try "ecsk cp --help".`)
+					os.Exit(1)
 				}
-				if !filepath.IsAbs(src[1]) {
-					fmt.Fprintln(os.Stderr, `The remote path must be absolute. Try "ecsk cp --help".`)
+				if s3Path.bucket == "" || s3Path.path == "" {
+					fmt.Fprintln(os.Stderr, `The S3 location must be "s3://bucket/key". Try "ecsk cp --help".`)
 					os.Exit(1)
 				}
-				opts.Src = src[1]
-				opts.Dst = dst[0]
-			} else if len(dst) > 1 {
+				if opts.Via == "exec" {
+					fmt.Fprintln(os.Stderr, "--via exec can't be used to transfer files with S3 locations.")
+					os.Exit(1)
+				}
+				opts.Bucket = s3Path.bucket
+				opts.S3Key = s3Path.path
+				if remotePath.task != "" {
+					opts.Task = remotePath.task
+				}
+				if remotePath.container != "" {
+					opts.Container = remotePath.container
+				}
+			} else if src.remote && dst.remote {
+				opts.RemoteToRemote = true
+				if src.task != "" {
+					opts.Task = src.task
+				}
+				if src.container != "" {
+					opts.Container = src.container
+				}
+				opts.DstTask = dst.task
+				opts.DstContainer = dst.container
+			} else if src.remote {
+				opts.FromRemote = true
+				if src.task != "" {
+					opts.Task = src.task
+				}
+				if src.container != "" {
+					opts.Container = src.container
+				}
+			} else if dst.remote {
 				opts.FromLocal = true
-				if dst[0] != "" {
-					opts.Container = dst[0]
+				if dst.task != "" {
+					opts.Task = dst.task
 				}
-				if !filepath.IsAbs(dst[1]) {
-					fmt.Fprintln(os.Stderr, `The remote path must be absolute. Try "ecsk cp --help".`)
-					os.Exit(1)
+				if dst.container != "" {
+					opts.Container = dst.container
 				}
-				opts.Src = src[0]
-				opts.Dst = dst[1]
 			} else {
 				fmt.Fprintln(os.Stderr, `Wrong format. Try "ecsk cp --help".`)
 				os.Exit(1)
 			}
+			opts.Src = src.path
+			opts.Dst = dst.path
+			opts.FromStdin = opts.FromLocal && opts.Src == "-"
+			opts.ToStdout = opts.FromRemote && opts.Dst == "-"
+			if (opts.FromStdin || opts.ToStdout) && opts.DryRun {
+				fmt.Fprintln(os.Stderr, `--dry-run can't be used with "-".`)
+				os.Exit(1)
+			}
+			if opts.ToStdout {
+				// Only the tar archive is written to stdout, and the prompts and the messages are written to stderr.
+				opts.Stdout = os.Stdout
+				ui.PromptToStderr()
+			}
+			_, err = store.NewFilter(opts.Include, opts.Exclude)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			err = store.ValidateCompress(opts.Compress)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if opts.Via == "exec" && opts.Compress == store.Zstd {
+				fmt.Fprintln(os.Stderr, `--compress zstd can't be used with --via exec. Use "gzip" instead.`)
+				os.Exit(1)
+			}
+			if opts.SetupBucket && (opts.Via == "exec" || opts.RemoteToS3 || opts.S3ToRemote) {
+				fmt.Fprintln(os.Stderr, "--setup-bucket can only be used for the bucket for file transfer.")
+				os.Exit(1)
+			}
+			if opts.RemoteToRemote && opts.Via == "exec" {
+				fmt.Fprintln(os.Stderr, "--via exec can't be used to transfer files between containers.")
+				os.Exit(1)
+			}
 
-			err = nextCpState(ctx, ecsClient, s3Client, ui.Cluster, opts)
+			state := ui.Cluster
+			// Listing local files requires no task
+			if opts.DryRun && opts.FromLocal {
+				state = ui.Complete
+			}
+			err = nextCpState(ctx, ecsClient, s3Client, state, opts)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
@@ -153,17 +354,31 @@ Transfer files from remote to local.`,
 	rootCmd.AddCommand(cpCmd)
 
 	cpCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The short name or full Amazon Resource Name (ARN) of the cluster that hosts the task.")
+	cpCmd.Flags().StringVar(&opts.Service, "service", "", "The name of the service the task belongs to. If the service has only one running task, it is chosen automatically, otherwise the tasks of the service are listed.")
 	cpCmd.Flags().StringVar(&opts.Task, "task", "", "The task ID or full Amazon Resource Name (ARN) of the task.")
 	cpCmd.Flags().StringVar(&opts.Container, "container", "", "The name of the container to copy files.")
 	cpCmd.Flags().StringVar(&opts.Bucket, "bucket", "", "The bucket to use for file transfer.")
-	cpCmd.Flags().StringVar(&opts.Plugin, "plugin", "session-manager-plugin", "Path of session-manager-plugin.")
+	cpCmd.Flags().BoolVarP(&opts.Archive, "archive", "a", false, "Archive mode (copy all uid/gid information).")
+	cpCmd.Flags().StringArrayVar(&opts.Include, "include", nil, "Transfer only the files matching the gitignore-style pattern. Can be specified multiple times.")
+	cpCmd.Flags().StringArrayVar(&opts.Exclude, "exclude", nil, "Don't transfer the files matching the gitignore-style pattern. Can be specified multiple times.")
+	cpCmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "List the files which would be transferred without transferring them. With --gc, list the transfers which would be deleted.")
+	cpCmd.Flags().StringVar(&opts.Compress, "compress", "", `Transfer files as a single tar archive compressed with the format. The accepted values are "gzip" and "zstd".`)
+	cpCmd.Flags().BoolVar(&opts.Presign, "presign", false, "Transfer files with presigned URLs generated locally, so the task role needs no S3 permissions.")
+	cpCmd.Flags().StringVar(&opts.Via, "via", "s3", `How to transfer files. The accepted values are "s3" and "exec".`)
+	cpCmd.Flags().BoolVar(&opts.SetupBucket, "setup-bucket", false, "Create or harden the bucket for file transfer with public access blocked, default encryption and a lifecycle rule.")
+	cpCmd.Flags().BoolVar(&opts.Gc, "gc", false, "Delete the objects and the incomplete multipart uploads left in the bucket by failed transfers.")
+	cpCmd.Flags().DurationVar(&opts.OlderThan, "older-than", 24*time.Hour, "With --gc, delete only the transfers last modified before this duration.")
+	cpCmd.Flags().StringVar(&opts.SSE, "sse", "", `The server-side encryption of the uploaded objects. The accepted values are "AES256", "aws:kms" and "aws:kms:dsse".`)
+	cpCmd.Flags().StringVar(&opts.SSEKMSKeyID, "sse-kms-key-id", "", "The ID of the KMS key for the server-side encryption. If specified without --sse, aws:kms is used.")
+	cpCmd.Flags().StringVar(&opts.BucketOwner, "expected-bucket-owner", "", "The account ID of the expected bucket owner. The requests fail if the bucket is owned by another account.")
+	cpCmd.Flags().StringVar(&opts.Plugin, "plugin", "", "Path of session-manager-plugin. If not specified, the built-in Session Manager client is used.")
 }
 
 func nextCpState(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, state int, opts CpCommandOptions) error {
 	switch state {
 	case ui.Cluster:
 		if opts.Cluster != "" {
-			return nextCpState(ctx, ecsClient, s3Client, ui.Task, opts)
+			return nextCpState(ctx, ecsClient, s3Client, ui.Service, opts)
 		}
 
 		result, err := ui.AskCluster(ctx, ecsClient, false)
@@ -175,27 +390,67 @@ func nextCpState(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client
 		}
 
 		opts.Cluster = result
+		return nextCpState(ctx, ecsClient, s3Client, ui.Service, opts)
+	case ui.Service:
+		if opts.Task != "" {
+			return nextCpState(ctx, ecsClient, s3Client, ui.Task, opts)
+		}
+		// With --service, the task is chosen automatically if the service has only one running task.
+		if opts.Service != "" {
+			result, err := ui.FindServiceTask(ctx, ecsClient, opts.Cluster, opts.Service)
+			if err != nil {
+				return err
+			}
+
+			opts.Task = result
+			return nextCpState(ctx, ecsClient, s3Client, ui.Task, opts)
+		}
+
+		result, err := ui.AskService(ctx, ecsClient, opts.Cluster, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			opts.Service = ""
+			return nextCpState(ctx, ecsClient, s3Client, ui.Cluster, opts)
+		}
+
+		opts.Service = result
 		return nextCpState(ctx, ecsClient, s3Client, ui.Task, opts)
 	case ui.Task:
 		if opts.Task != "" {
 			return nextCpState(ctx, ecsClient, s3Client, ui.Container, opts)
 		}
 
-		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, true)
+		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, opts.Service, true)
 		if err != nil {
 			return err
 		}
 		if result == "" {
-			opts.Cluster = ""
 			opts.Task = ""
-			return nextCpState(ctx, ecsClient, s3Client, ui.Cluster, opts)
+			// The service step is skipped if the cluster has no services
+			if opts.Service == ui.NoServices {
+				opts.Cluster = ""
+				opts.Service = ""
+				return nextCpState(ctx, ecsClient, s3Client, ui.Cluster, opts)
+			}
+			opts.Service = ""
+			return nextCpState(ctx, ecsClient, s3Client, ui.Service, opts)
 		}
 
 		opts.Task = result
 		return nextCpState(ctx, ecsClient, s3Client, ui.Container, opts)
 	case ui.Container:
+		next := ui.Bucket
+		if opts.DryRun || opts.Via == "exec" {
+			next = ui.Complete
+		} else if opts.RemoteToRemote {
+			next = ui.DstTask
+		}
+
 		if opts.Container != "" {
-			return nextCpState(ctx, ecsClient, s3Client, ui.Bucket, opts)
+			return nextCpState(ctx, ecsClient, s3Client, next, opts)
 		}
 
 		result, err := ui.AskContainer(ctx, ecsClient, opts.Cluster, opts.Task, true)
@@ -209,6 +464,41 @@ func nextCpState(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client
 		}
 
 		opts.Container = result
+		return nextCpState(ctx, ecsClient, s3Client, next, opts)
+	case ui.DstTask:
+		if opts.DstTask != "" {
+			return nextCpState(ctx, ecsClient, s3Client, ui.DstContainer, opts)
+		}
+
+		fmt.Println("Select the destination.")
+		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, "", true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Container = ""
+			opts.DstTask = ""
+			return nextCpState(ctx, ecsClient, s3Client, ui.Container, opts)
+		}
+
+		opts.DstTask = result
+		return nextCpState(ctx, ecsClient, s3Client, ui.DstContainer, opts)
+	case ui.DstContainer:
+		if opts.DstContainer != "" {
+			return nextCpState(ctx, ecsClient, s3Client, ui.Bucket, opts)
+		}
+
+		result, err := ui.AskContainer(ctx, ecsClient, opts.Cluster, opts.DstTask, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.DstTask = ""
+			opts.DstContainer = ""
+			return nextCpState(ctx, ecsClient, s3Client, ui.DstTask, opts)
+		}
+
+		opts.DstContainer = result
 		return nextCpState(ctx, ecsClient, s3Client, ui.Bucket, opts)
 	case ui.Bucket:
 		if opts.Bucket != "" {
@@ -220,14 +510,33 @@ func nextCpState(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client
 			return err
 		}
 		if result == "" {
-			opts.Container = ""
 			opts.Bucket = ""
+			if opts.RemoteToRemote {
+				opts.DstContainer = ""
+				return nextCpState(ctx, ecsClient, s3Client, ui.DstTask, opts)
+			}
+			opts.Container = ""
 			return nextCpState(ctx, ecsClient, s3Client, ui.Task, opts)
 		}
 
 		opts.Bucket = result
 		return nextCpState(ctx, ecsClient, s3Client, ui.Complete, opts)
 	case ui.Complete:
+		if opts.DryRun {
+			return startCpDryRun(ctx, ecsClient, s3Client, opts)
+		}
+		if opts.SetupBucket {
+			err := store.SetupBucket(ctx, s3Client, opts.Bucket, opts.Region)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.Via == "exec" {
+			return startCpViaExec(ctx, ecsClient, opts)
+		}
+		if opts.RemoteToS3 || opts.S3ToRemote {
+			return startCpWithS3(ctx, ecsClient, s3Client, opts)
+		}
 		return startCp(ctx, ecsClient, s3Client, opts)
 	}
 
@@ -235,93 +544,505 @@ func nextCpState(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client
 }
 
 func startCp(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts CpCommandOptions) error {
-	t := time.Now()
-	key := "ecsk_" + t.Format("20060102150405")
-
-	var keys []string
-	var url = DownloadUrl
-
-	var f, err = isArm64Architecture(ctx, ecsClient, opts)
+	filter, err := store.NewFilter(opts.Include, opts.Exclude)
 	if err != nil {
 		return err
 	}
-	if f {
-		url = DownloadUrlForArm64
+
+	// Reuse the key of the previous run of the same transfer which failed, so that the transfer is resumed.
+	// Tar streams can't be resumed, because they can't be read again.
+	stream := opts.FromStdin || opts.ToStdout
+	id := transferID(opts)
+	var key string
+	var resumed bool
+	if !stream {
+		key, resumed = store.LoadTransferKey(id)
+	}
+	opts.Resume = resumed
+	if resumed {
+		fmt.Fprintln(opts.logOutput(), "Resuming the previous transfer...")
+	} else {
+		t := time.Now()
+		key = store.TransferPrefix + t.Format("20060102150405")
+		if !stream {
+			err := store.SaveTransferKey(id, key)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "The transfer can't be resumed:", err)
+			}
+		}
+	}
+
+	var keys []string
+	archive := opts.archive()
+	if archive {
+		keys = []string{store.ArchiveKey(key, opts.Compress)}
 	}
 
 	if opts.FromLocal {
-		var err error
-		keys, err = store.Upload(ctx, s3Client, opts.Bucket, key, opts.Src)
+		helperPath, err := installCpHelper(ctx, ecsClient, opts)
 		if err != nil {
 			return err
 		}
 
-		err = startExec(ctx, ecsClient, ExecCommandOptions{
-			Cluster:            opts.Cluster,
-			Task:               opts.Task,
-			Container:          opts.Container,
-			Interactive:        true,
-			Plugin:             opts.Plugin,
-			EnableErrorChecker: false,
-			Command:            fmt.Sprintf(Format, url, key, 1, opts.Bucket, key, filepath.ToSlash(opts.Dst)),
-			Region:             opts.Region,
-			Profile:            opts.Profile,
-		})
+		if opts.FromStdin {
+			err = store.UploadStream(ctx, s3Client, opts.Bucket, store.ArchiveKey(key, opts.Compress), os.Stdin, opts.Compress)
+		} else if archive {
+			err = store.UploadArchive(ctx, s3Client, opts.Bucket, store.ArchiveKey(key, opts.Compress), opts.Src, filter, opts.Compress)
+		} else {
+			keys, err = store.Upload(ctx, s3Client, opts.Bucket, key, opts.Src, filter, opts.Resume)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = receiveInContainer(ctx, ecsClient, s3Client, opts, helperPath, key, opts.Dst)
 		if err != nil {
 			return err
 		}
 	} else if opts.FromRemote {
-		err := startExec(ctx, ecsClient, ExecCommandOptions{
-			Cluster:            opts.Cluster,
-			Task:               opts.Task,
-			Container:          opts.Container,
-			Interactive:        true,
-			Plugin:             opts.Plugin,
-			EnableErrorChecker: false,
-			Command:            fmt.Sprintf(Format, url, key, 0, opts.Bucket, key, filepath.ToSlash(opts.Src)),
-			Region:             opts.Region,
-			Profile:            opts.Profile,
-		})
+		helperPath, err := installCpHelper(ctx, ecsClient, opts)
+		if err != nil {
+			return err
+		}
+
+		err = sendFromContainer(ctx, ecsClient, s3Client, opts, helperPath, key, opts.Src)
+		if err != nil {
+			return err
+		}
+
+		if opts.ToStdout {
+			err = store.DownloadStream(ctx, s3Client, opts.Bucket, store.ArchiveKey(key, opts.Compress), opts.Stdout)
+		} else if archive {
+			err = store.DownloadArchive(ctx, s3Client, opts.Bucket, store.ArchiveKey(key, opts.Compress), opts.Dst, opts.Archive, nil)
+		} else {
+			keys, err = store.Download(ctx, s3Client, opts.Bucket, key, opts.Dst, nil)
+		}
+		if err != nil {
+			return err
+		}
+	} else if opts.RemoteToRemote {
+		dstOpts := opts
+		dstOpts.Task = opts.DstTask
+		dstOpts.Container = opts.DstContainer
+
+		srcHelperPath, err := installCpHelper(ctx, ecsClient, opts)
+		if err != nil {
+			return err
+		}
+		dstHelperPath, err := installCpHelper(ctx, ecsClient, dstOpts)
 		if err != nil {
 			return err
 		}
 
-		keys, err = store.Download(ctx, s3Client, opts.Bucket, key, opts.Dst)
+		err = sendFromContainer(ctx, ecsClient, s3Client, opts, srcHelperPath, key, opts.Src)
 		if err != nil {
 			return err
 		}
+		err = receiveInContainer(ctx, ecsClient, s3Client, dstOpts, dstHelperPath, key, opts.Dst)
+		if err != nil {
+			return err
+		}
+
+		if !archive {
+			keys, err = store.ListKeys(ctx, s3Client, opts.Bucket, key)
+			if err != nil {
+				return err
+			}
+		}
 	} else {
 		return errors.New("Unknown error.")
 	}
 
-	var objects []types.ObjectIdentifier
+	var safeKeys []string
 	for _, k := range keys {
-		clone := k
 		// Safety
-		if !strings.Contains(clone, key) {
+		if !strings.Contains(k, key) {
 			continue
 		}
-		objects = append(objects, types.ObjectIdentifier{
-			Key: &clone,
-		})
+		safeKeys = append(safeKeys, k)
 	}
 
-	if len(objects) > 0 {
-		_, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-			Bucket: &opts.Bucket,
-			Delete: &types.Delete{
-				Objects: objects,
-				Quiet:   false,
-			},
-		})
+	err = store.DeleteKeys(ctx, s3Client, opts.Bucket, safeKeys)
+	if err != nil {
+		return err
+	}
+
+	return store.DeleteTransferKey(id)
+}
+
+// setupCpBucket hardens the bucket without transferring files.
+func setupCpBucket(ctx context.Context, s3Client *s3.Client, opts CpCommandOptions) error {
+	if opts.Bucket == "" {
+		result, err := ui.AskBucket(ctx, s3Client, opts.Region, false)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			return errors.New("Canceled.")
+		}
+		opts.Bucket = result
+	}
+
+	return store.SetupBucket(ctx, s3Client, opts.Bucket, opts.Region)
+}
+
+// startCpGc deletes the transfers older than --older-than left in the bucket.
+func startCpGc(ctx context.Context, s3Client *s3.Client, opts CpCommandOptions) error {
+	if opts.Bucket == "" {
+		result, err := ui.AskBucket(ctx, s3Client, opts.Region, false)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			return errors.New("Canceled.")
+		}
+		opts.Bucket = result
+	}
+
+	transfers, err := store.ListTransfers(ctx, s3Client, opts.Bucket)
+	if err != nil {
+		return err
+	}
+
+	var stale []*store.Transfer
+	for _, t := range transfers {
+		if time.Since(t.LastModified) < opts.OlderThan {
+			continue
+		}
+		stale = append(stale, t)
+		fmt.Printf("%s\t%d objects (%d bytes), %d incomplete uploads\t%s\n", t.Name, len(t.Keys), t.Size, t.Uploads(), t.LastModified.Local().Format("2006-01-02 15:04:05"))
+	}
+	if opts.DryRun {
+		fmt.Printf("%d transfers would be deleted\n", len(stale))
+		return nil
+	}
+
+	for _, t := range stale {
+		err := store.DeleteTransfer(ctx, s3Client, opts.Bucket, t)
 		if err != nil {
 			return err
 		}
 	}
+	fmt.Printf("Deleted %d transfers\n", len(stale))
 
 	return nil
 }
 
+// startCpDryRun lists the files in the source which would be transferred.
+func startCpDryRun(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts CpCommandOptions) error {
+	filter, err := store.NewFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	if opts.FromLocal {
+		return store.DryRun(opts.Src, filter)
+	}
+	if opts.S3ToRemote {
+		keys, err := store.ListKeys(ctx, s3Client, opts.Bucket, opts.S3Key)
+		if err != nil {
+			return err
+		}
+
+		prefix := strings.TrimSuffix(opts.S3Key, "/") + "/"
+		n := 0
+		for _, k := range keys {
+			rel := strings.TrimPrefix(k, prefix)
+			if !filter.Match(rel, false) {
+				continue
+			}
+			fmt.Println(rel)
+			n++
+		}
+		fmt.Printf("%d files would be transferred\n", n)
+		return nil
+	}
+
+	helperPath, err := installCpHelper(ctx, ecsClient, opts)
+	if err != nil {
+		return err
+	}
+	return startCpHelper(ctx, ecsClient, opts, helperCommand(helperPath, opts, "list", filepath.ToSlash(opts.Src)))
+}
+
+// startCpWithS3 transfers files between the container and the S3 location directly, and keeps the objects.
+func startCpWithS3(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts CpCommandOptions) error {
+	helperPath, err := installCpHelper(ctx, ecsClient, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.RemoteToS3 {
+		key := opts.S3Key
+		// The archive to the prefix is put inside it with the name of the source directory.
+		if opts.archive() && strings.HasSuffix(key, "/") {
+			filter, err := store.NewFilter(opts.Include, opts.Exclude)
+			if err != nil {
+				return err
+			}
+			root, _, err := filter.Glob(opts.Src)
+			if err != nil {
+				return err
+			}
+			name := path.Base(filepath.ToSlash(root))
+			if name == "/" || name == "." {
+				name = "root"
+			}
+			key += name
+		}
+		return sendFromContainer(ctx, ecsClient, s3Client, opts, helperPath, key, opts.Src)
+	}
+	return receiveInContainer(ctx, ecsClient, s3Client, opts, helperPath, opts.S3Key, opts.Dst)
+}
+
+// sendFromContainer runs the cp helper in the container of opts to send src to the key.
+func sendFromContainer(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts CpCommandOptions, helperPath string, key string, src string) error {
+	src = filepath.ToSlash(src)
+
+	command := helperCommand(helperPath, opts, "0", opts.Bucket, key, src)
+	if opts.Presign {
+		url, header, err := store.PresignPut(ctx, s3Client, opts.Bucket, store.ArchiveKey(key, opts.Compress))
+		if err != nil {
+			return err
+		}
+		return startCpHelperWithURL(ctx, ecsClient, opts, helperCommand(helperPath, opts, append(headerArgs(header), "put", src)...), url)
+	} else if opts.archive() {
+		command = helperCommand(helperPath, opts, "pack", opts.Bucket, store.ArchiveKey(key, opts.Compress), src)
+	}
+
+	return startCpHelper(ctx, ecsClient, opts, command)
+}
+
+// receiveInContainer runs the cp helper in the container of opts to receive the key into dst.
+func receiveInContainer(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts CpCommandOptions, helperPath string, key string, dst string) error {
+	dst = filepath.ToSlash(dst)
+
+	command := helperCommand(helperPath, opts, "1", opts.Bucket, key, dst)
+	if opts.Presign {
+		url, header, err := store.PresignGet(ctx, s3Client, opts.Bucket, store.ArchiveKey(key, opts.Compress))
+		if err != nil {
+			return err
+		}
+		return startCpHelperWithURL(ctx, ecsClient, opts, helperCommand(helperPath, opts, append(headerArgs(header), "get", dst)...), url)
+	} else if opts.archive() {
+		command = helperCommand(helperPath, opts, "unpack", opts.Bucket, store.ArchiveKey(key, opts.Compress), dst)
+	}
+
+	return startCpHelper(ctx, ecsClient, opts, command)
+}
+
+func startCpHelper(ctx context.Context, ecsClient *ecs.Client, opts CpCommandOptions, command string) error {
+	return startExec(ctx, ecsClient, ExecCommandOptions{
+		Cluster:            opts.Cluster,
+		Task:               opts.Task,
+		Container:          opts.Container,
+		Interactive:        true,
+		Plugin:             opts.Plugin,
+		EnableErrorChecker: false,
+		ExitCode:           true,
+		Command:            command,
+		Stdout:             opts.logOutput(),
+		Region:             opts.Region,
+		Profile:            opts.Profile,
+	})
+}
+
+// startCpHelperWithURL sends the presigned URL to the cp helper through stdin, so that it's not recorded in CloudTrail with the command.
+func startCpHelperWithURL(ctx context.Context, ecsClient *ecs.Client, opts CpCommandOptions, command string, url string) error {
+	// Echo is disabled so that the URL sent through the terminal is not printed.
+	script := fmt.Sprintf(`stty -echo 2> /dev/null; printf "%s\n"; exec %s`, readyMarker, command)
+	sent, err := startExecWithInput(ctx, ecsClient, ExecCommandOptions{
+		Cluster:            opts.Cluster,
+		Task:               opts.Task,
+		Container:          opts.Container,
+		Interactive:        true,
+		Plugin:             opts.Plugin,
+		EnableErrorChecker: false,
+		ExitCode:           true,
+		Command:            "sh -c " + shellQuote(script),
+		Stdout:             opts.logOutput(),
+		Region:             opts.Region,
+		Profile:            opts.Profile,
+	}, func(w io.Writer) error {
+		_, err := io.WriteString(w, url)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !sent {
+		return errors.New("Failed to send the presigned URL.")
+	}
+
+	return nil
+}
+
+// logOutput returns the writer of the messages, which is stderr if stdout is used for the tar stream.
+func (opts CpCommandOptions) logOutput() io.Writer {
+	if opts.ToStdout {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// archive reports whether files are transferred as a single tar archive.
+// It is required with presigned URLs, in archive mode, with compression, and for tar streams.
+func (opts CpCommandOptions) archive() bool {
+	return opts.Presign || opts.Archive || opts.Compress != "" || opts.FromStdin || opts.ToStdout
+}
+
+func (opts CpCommandOptions) bucketOptions() store.BucketOptions {
+	return store.BucketOptions{
+		SSE:                 opts.SSE,
+		SSEKMSKeyID:         opts.SSEKMSKeyID,
+		ExpectedBucketOwner: opts.BucketOwner,
+	}
+}
+
+func transferID(opts CpCommandOptions) string {
+	src := opts.Src
+	dst := opts.Dst
+	if opts.FromLocal {
+		src, _ = filepath.Abs(src)
+	} else if opts.FromRemote {
+		dst, _ = filepath.Abs(dst)
+	}
+	return store.TransferID(opts.Cluster, opts.Task, opts.Container, opts.DstTask, opts.DstContainer, opts.Bucket, src, dst)
+}
+
+type cpPath struct {
+	task      string
+	container string
+	bucket    string
+	path      string
+	remote    bool
+	s3        bool
+}
+
+// parseCpPath parses "s3://bucket/key" as an S3 location, "[task_id/][container_name]:path" as a remote path, and the others as a local path.
+func parseCpPath(arg string) cpPath {
+	if strings.HasPrefix(arg, "s3://") {
+		p := cpPath{s3: true}
+		p.bucket, p.path, _ = strings.Cut(strings.TrimPrefix(arg, "s3://"), "/")
+		return p
+	}
+
+	i := strings.Index(arg, ":")
+	if i < 0 {
+		return cpPath{path: arg}
+	}
+
+	p := cpPath{path: arg[i+1:], remote: true}
+	target := arg[:i]
+	if j := strings.Index(target, "/"); j >= 0 {
+		p.task = target[:j]
+		p.container = target[j+1:]
+	} else {
+		p.container = target
+	}
+	return p
+}
+
+// helperCommand returns the command line to run the cp helper with the arguments quoted.
+func helperCommand(helperPath string, opts CpCommandOptions, args ...string) string {
+	command := helperPath
+	if opts.Archive {
+		command += " -a"
+	}
+	if opts.Compress != "" {
+		command += " -compress " + shellQuote(opts.Compress)
+	}
+	if opts.Resume {
+		command += " -resume"
+	}
+	for _, p := range opts.Include {
+		command += " -include " + shellQuote(p)
+	}
+	for _, p := range opts.Exclude {
+		command += " -exclude " + shellQuote(p)
+	}
+	if opts.SSE != "" {
+		command += " -sse " + shellQuote(opts.SSE)
+	}
+	if opts.SSEKMSKeyID != "" {
+		command += " -sse-kms-key-id " + shellQuote(opts.SSEKMSKeyID)
+	}
+	if opts.BucketOwner != "" {
+		command += " -expected-bucket-owner " + shellQuote(opts.BucketOwner)
+	}
+	for _, a := range args {
+		command += " " + shellQuote(a)
+	}
+	return command
+}
+
+// headerArgs returns the flags of the cp helper to send the headers signed with the presigned URL.
+func headerArgs(header http.Header) []string {
+	var keys []string
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, k := range keys {
+		for _, v := range header[k] {
+			args = append(args, "-header", k+": "+v)
+		}
+	}
+	return args
+}
+
+// installCpHelper sends the embedded cp helper to the container through the exec session, and returns the path.
+// The helper is cached in the container, and its checksum is verified every time before it is executed.
+func installCpHelper(ctx context.Context, ecsClient *ecs.Client, opts CpCommandOptions) (string, error) {
+	arch := "amd64"
+	f, err := isArm64Architecture(ctx, ecsClient, opts)
+	if err != nil {
+		return "", err
+	}
+	if f {
+		arch = "arm64"
+	}
+
+	b, sum, err := helper.Binary(arch)
+	if err != nil {
+		return "", err
+	}
+
+	helperPath := "/tmp/ecsk_cp_" + sum[:16]
+	script := fmt.Sprintf(
+		`f=%s; [ -x "$f" ] && [ "$(sha256sum "$f" | cut -d " " -f 1)" = %s ] && exit 0; `+
+			`for c in base64 sha256sum; do command -v $c > /dev/null 2>&1 || { echo "$c command is required in the container." >&2; exit 1; }; done; `+
+			`stty -echo 2> /dev/null; printf "%s\n"; base64 -d > "$f.tmp" && [ "$(sha256sum "$f.tmp" | cut -d " " -f 1)" = %[2]s ] || { rm -f "$f.tmp"; echo "Checksum of the cp helper does not match." >&2; exit 1; }; `+
+			`chmod +x "$f.tmp" && mv "$f.tmp" "$f"`,
+		shellQuote(helperPath), sum, readyMarker,
+	)
+
+	_, err = startExecWithInput(ctx, ecsClient, ExecCommandOptions{
+		Cluster:            opts.Cluster,
+		Task:               opts.Task,
+		Container:          opts.Container,
+		Interactive:        true,
+		EnableErrorChecker: false,
+		ExitCode:           true,
+		Command:            "sh -c " + shellQuote(script),
+		Plugin:             opts.Plugin,
+		Stdout:             opts.logOutput(),
+		Region:             opts.Region,
+		Profile:            opts.Profile,
+	}, func(w io.Writer) error {
+		fmt.Fprintln(opts.logOutput(), "Installing the cp helper into the container...")
+		_, err := w.Write(b)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return helperPath, nil
+}
+
 func isArm64Architecture(ctx context.Context, ecsClient *ecs.Client, opts CpCommandOptions) (bool, error) {
 	var tasks = []string{opts.Task}
 	result, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
@@ -347,3 +1068,324 @@ func findCpuArchitectureName(attrs []ecsTypes.Attribute) string {
 	}
 	return ""
 }
+
+const (
+	readyMarker  = "ecsk-ready"
+	beginMarker  = "ecsk-begin"
+	endMarker    = "ecsk-end"
+	sha256Marker = "ecsk-sha256"
+)
+
+// The commands check the tools, and disable echo so that the archive sent through the terminal is not returned.
+// The archive is written to the temporary file, so that the exit status of tar and the SHA-256 checksum of the archive are checked.
+const execTransferPrefix = `for c in tar base64 sha256sum; do command -v $c > /dev/null 2>&1 || { echo "$c command is required in the container." >&2; exit 1; }; done; stty -echo 2> /dev/null; t="${TMPDIR:-/tmp}/ecsk_cp_$$.tar"; trap 'rm -f "$t"' EXIT; `
+
+func startCpViaExec(ctx context.Context, ecsClient *ecs.Client, opts CpCommandOptions) error {
+	execOpts := ExecCommandOptions{
+		Cluster:            opts.Cluster,
+		Task:               opts.Task,
+		Container:          opts.Container,
+		Interactive:        true,
+		EnableErrorChecker: false,
+		ExitCode:           true,
+		Plugin:             opts.Plugin,
+		Region:             opts.Region,
+		Profile:            opts.Profile,
+	}
+
+	filter, err := store.NewFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	if opts.FromLocal {
+		dst := shellQuote(filepath.ToSlash(opts.Dst))
+		flags := "x"
+		if opts.Compress == store.Gzip {
+			flags += "z"
+		}
+		// Without archive mode, the files are owned by the user in the container like "docker cp".
+		if !opts.Archive {
+			flags += "o"
+		}
+		flags += "f"
+
+		pack := func(w io.Writer) error {
+			if opts.FromStdin {
+				return store.CopyArchive(w, os.Stdin, filter)
+			}
+			return store.Pack(w, opts.Src, filter, false)
+		}
+		// The archive is extracted by the tar command in the container, so the checksum of the whole archive is verified instead of the files.
+		archive, sum, err := packTemp(func(w io.Writer) error {
+			if opts.Compress == store.Gzip {
+				gw := gzip.NewWriter(w)
+				err := pack(gw)
+				if err != nil {
+					return err
+				}
+				return gw.Close()
+			}
+			return pack(w)
+		})
+		if err != nil {
+			return err
+		}
+		defer os.Remove(archive.Name())
+		defer archive.Close()
+
+		execOpts.Command = "sh -c " + shellQuote(fmt.Sprintf(
+			`%[1]smkdir -p %[2]s || exit 1; printf "%[3]s\n"; base64 -d > "$t" && [ "$(sha256sum "$t" | cut -d " " -f 1)" = %[4]s ] || { echo "Checksum of the archive does not match." >&2; exit 1; }; tar %[5]s "$t" -C %[2]s`,
+			execTransferPrefix, dst, readyMarker, sum, flags,
+		))
+
+		sent, err := startExecWithInput(ctx, ecsClient, execOpts, func(w io.Writer) error {
+			_, err := io.Copy(w, archive)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !sent {
+			return errors.New("Failed to start the transfer.")
+		}
+
+		return nil
+	} else if opts.FromRemote {
+		// The container sends all files in the directory of the wildcards, and they are filtered on unpacking.
+		src, filter, err := filter.Glob(filepath.ToSlash(opts.Src))
+		if err != nil {
+			return err
+		}
+		// The archive is decompressed automatically on unpacking.
+		flags := "cf"
+		if opts.Compress == store.Gzip {
+			flags = "czf"
+		}
+		execOpts.Command = "sh -c " + shellQuote(fmt.Sprintf(
+			`%[1]s[ -e %[2]s ] || { echo "%[3]s: No such file or directory" >&2; exit 1; }; if [ -d %[2]s ]; then tar %[4]s "$t" -C %[2]s .; else tar %[4]s "$t" -C %[5]s %[6]s; fi || exit 1; printf "%[7]s %%s\n" "$(sha256sum "$t" | cut -d " " -f 1)"; printf "%[8]s\n"; base64 "$t"; printf "%[9]s\n"`,
+			execTransferPrefix, shellQuote(src), src, flags, shellQuote(path.Dir(src)), shellQuote(path.Base(src)), sha256Marker, beginMarker, endMarker,
+		))
+
+		dataReader, dataWriter := io.Pipe()
+		w := &execTransferWriter{data: dataWriter, other: os.Stderr}
+		h := sha256.New()
+		errs := make(chan error, 1)
+		go func() {
+			r := io.TeeReader(base64.NewDecoder(base64.StdEncoding, dataReader), h)
+			var err error
+			if opts.ToStdout {
+				err = store.CopyArchive(opts.Stdout, r, filter)
+			} else {
+				err = store.Unpack(r, opts.Dst, opts.Archive, filter)
+			}
+			if err == nil {
+				// Read the padding after the end of the archive for the checksum
+				_, err = io.Copy(io.Discard, r)
+			}
+			dataReader.CloseWithError(err)
+			errs <- err
+		}()
+
+		execOpts.Stdin = strings.NewReader("")
+		execOpts.Stdout = w
+		err = startExec(ctx, ecsClient, execOpts)
+		w.Close()
+		dataWriter.Close()
+		if err != nil {
+			return err
+		}
+
+		err = <-errs
+		if err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); w.sum != sum {
+			return fmt.Errorf("SHA-256 mismatch of the archive: expected %s, but got %s", w.sum, sum)
+		}
+
+		return nil
+	}
+
+	return errors.New("Unknown error.")
+}
+
+// packTemp writes the archive to the temporary file, and returns the file at the beginning and the SHA-256 checksum of the archive.
+func packTemp(pack func(w io.Writer) error) (*os.File, string, error) {
+	f, err := os.CreateTemp("", "ecsk_cp_*.tar")
+	if err != nil {
+		return nil, "", err
+	}
+
+	h := sha256.New()
+	err = pack(io.MultiWriter(f, h))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+
+	return f, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// startExecWithInput sends the data written by write to the command after the command prints the ready marker.
+// It returns false if the command exited without the ready marker.
+func startExecWithInput(ctx context.Context, ecsClient *ecs.Client, execOpts ExecCommandOptions, write func(w io.Writer) error) (bool, error) {
+	stdinReader, stdinWriter := io.Pipe()
+	w := &execTransferWriter{other: os.Stdout, ready: make(chan struct{})}
+	if execOpts.Stdout != nil {
+		w.other = execOpts.Stdout
+	}
+	// The command exits without the ready marker if there is nothing to receive, like the cached cp helper.
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			errs <- ctx.Err()
+			return
+		case <-done:
+			errs <- nil
+			return
+		case <-w.ready:
+		}
+
+		errs <- writeEncoded(stdinWriter, write)
+	}()
+
+	execOpts.Stdin = stdinReader
+	execOpts.Stdout = w
+	err := startExec(ctx, ecsClient, execOpts)
+	close(done)
+	stdinReader.Close()
+	w.Close()
+	if err != nil {
+		return false, err
+	}
+
+	select {
+	case <-w.ready:
+		return true, <-errs
+	default:
+		return false, nil
+	}
+}
+
+func writeEncoded(w *io.PipeWriter, write func(w io.Writer) error) error {
+	lw := &lineWriter{w: w, width: 76}
+	enc := base64.NewEncoder(base64.StdEncoding, lw)
+
+	err := write(enc)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		// Send EOF of the terminal
+		_, err = w.Write([]byte("\n\x04"))
+	}
+	if err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+
+	return w.Close()
+}
+
+// lineWriter breaks lines at the width, because the terminal can't accept too long lines.
+type lineWriter struct {
+	w      io.Writer
+	width  int
+	column int
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	var buf []byte
+	for _, b := range p {
+		buf = append(buf, b)
+		w.column++
+		if w.column == w.width {
+			buf = append(buf, '\n')
+			w.column = 0
+		}
+	}
+
+	_, err := w.w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// execTransferWriter splits the output of the transfer command by lines into the data between the markers and the others.
+type execTransferWriter struct {
+	data   io.Writer
+	other  io.Writer
+	ready  chan struct{}
+	sum    string
+	line   []byte
+	inData bool
+}
+
+func (w *execTransferWriter) Write(p []byte) (int, error) {
+	w.line = append(w.line, p...)
+
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := w.line[:i+1]
+		err := w.writeLine(line)
+		if err != nil {
+			return 0, err
+		}
+		w.line = w.line[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *execTransferWriter) writeLine(line []byte) error {
+	text := strings.TrimRight(string(line), "\r\n")
+	if sum, ok := strings.CutPrefix(text, sha256Marker+" "); ok && !w.inData {
+		w.sum = sum
+		return nil
+	}
+
+	switch text {
+	case readyMarker:
+		if w.ready != nil {
+			close(w.ready)
+		}
+		return nil
+	case beginMarker:
+		w.inData = true
+		return nil
+	case endMarker:
+		w.inData = false
+		return nil
+	}
+
+	if w.inData {
+		_, err := w.data.Write(bytes.TrimRight(line, "\r\n"))
+		return err
+	}
+
+	_, err := w.other.Write(line)
+	return err
+}
+
+func (w *execTransferWriter) Close() error {
+	line := w.line
+	w.line = nil
+	if len(line) == 0 {
+		return nil
+	}
+
+	return w.writeLine(line)
+}
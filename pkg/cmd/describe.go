@@ -38,6 +38,7 @@ import (
 
 type DescribeCommandOptions struct {
 	Cluster string
+	Service string
 	Tasks   []string
 }
 
@@ -90,6 +91,7 @@ You can also use it to check a task list.`,
 	rootCmd.AddCommand(execCmd)
 
 	execCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The short name or full Amazon Resource Name (ARN) of the cluster that hosts the task.")
+	execCmd.Flags().StringVar(&opts.Service, "service", "", "The name of the service the tasks belong to. Only the tasks of the service are listed.")
 	execCmd.Flags().StringSliceVar(&opts.Tasks, "tasks", nil, "The task IDs or full Amazon Resource Name (ARN) of the tasks.")
 }
 
@@ -97,7 +99,7 @@ func nextDescribeState(ctx context.Context, ecsClient *ecs.Client, state int, op
 	switch state {
 	case ui.Cluster:
 		if opts.Cluster != "" {
-			return nextDescribeState(ctx, ecsClient, ui.Tasks, opts)
+			return nextDescribeState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		result, err := ui.AskCluster(ctx, ecsClient, false)
@@ -109,20 +111,42 @@ func nextDescribeState(ctx context.Context, ecsClient *ecs.Client, state int, op
 		}
 
 		opts.Cluster = result
+		return nextDescribeState(ctx, ecsClient, ui.Service, opts)
+	case ui.Service:
+		if opts.Tasks != nil || opts.Service != "" {
+			return nextDescribeState(ctx, ecsClient, ui.Tasks, opts)
+		}
+
+		result, err := ui.AskService(ctx, ecsClient, opts.Cluster, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			return nextDescribeState(ctx, ecsClient, ui.Cluster, opts)
+		}
+
+		opts.Service = result
 		return nextDescribeState(ctx, ecsClient, ui.Tasks, opts)
 	case ui.Tasks:
 		if opts.Tasks != nil {
 			return nextDescribeState(ctx, ecsClient, ui.Complete, opts)
 		}
 
-		result, err := ui.AskTasks(ctx, ecsClient, opts.Cluster)
+		result, err := ui.AskTasks(ctx, ecsClient, opts.Cluster, opts.Service, true)
 		if err != nil {
 			return err
 		}
 		if result == nil {
-			opts.Cluster = ""
 			opts.Tasks = nil
-			return nextDescribeState(ctx, ecsClient, ui.Cluster, opts)
+			// The service step is skipped if the cluster has no services
+			if opts.Service == ui.NoServices {
+				opts.Cluster = ""
+				opts.Service = ""
+				return nextDescribeState(ctx, ecsClient, ui.Cluster, opts)
+			}
+			opts.Service = ""
+			return nextDescribeState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		opts.Tasks = result
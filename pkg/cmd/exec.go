@@ -22,39 +22,52 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/spf13/cobra"
+	"github.com/yukiarrr/ecsk/pkg/session"
 	"github.com/yukiarrr/ecsk/pkg/store"
 	"github.com/yukiarrr/ecsk/pkg/ui"
 	"github.com/yukiarrr/ecsk/pkg/util"
+	"golang.org/x/term"
 )
 
 type ExecCommandOptions struct {
 	Cluster            string
+	Service            string
 	Task               string
 	Container          string
 	Interactive        bool
 	Plugin             string
 	EnableErrorChecker bool
+	ExitCode           bool
 	Command            string
 	Region             string
 	Profile            string
+	Stdin              io.Reader
+	Stdout             io.Writer
 }
 
+// defaultPlugin is used if the built-in Session Manager client doesn't support the session.
+const defaultPlugin = "session-manager-plugin"
+
 //go:embed amazon-ecs-exec-checker/check-ecs-exec.sh
 var checkScript []byte
 
@@ -107,6 +120,10 @@ After selecting the task and container interactively, and execute the command.`,
 
 			err = nextExecState(ctx, ecsClient, ui.Cluster, opts)
 			if err != nil {
+				var exitErr *util.ExitError
+				if errors.As(err, &exitErr) {
+					os.Exit(exitErr.Code)
+				}
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
@@ -116,18 +133,20 @@ After selecting the task and container interactively, and execute the command.`,
 	rootCmd.AddCommand(execCmd)
 
 	execCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The Amazon Resource Name (ARN) or short name of the cluster the task is running in. (From AWS CLI)")
+	execCmd.Flags().StringVar(&opts.Service, "service", "", "The name of the service the task belongs to. If the service has only one running task, it is chosen automatically, otherwise the tasks of the service are listed.")
 	execCmd.Flags().StringVar(&opts.Task, "task", "", "The Amazon Resource Name (ARN) or ID of the task the container is part of. (From AWS CLI)")
 	execCmd.Flags().StringVar(&opts.Container, "container", "", "The name of the container to execute the command on. (From AWS CLI)")
 	execCmd.Flags().BoolVarP(&opts.Interactive, "interactive", "i", false, "Use this flag to run your command in interactive mode. (From AWS CLI)")
-	execCmd.Flags().StringVar(&opts.Plugin, "plugin", "session-manager-plugin", "Path of session-manager-plugin.")
+	execCmd.Flags().StringVar(&opts.Plugin, "plugin", "", "Path of session-manager-plugin. If not specified, the built-in Session Manager client is used.")
 	execCmd.Flags().BoolVar(&opts.EnableErrorChecker, "enable-error-checker", true, "Whether to enable the error checker.")
+	execCmd.Flags().BoolVar(&opts.ExitCode, "exit-code", true, "Whether to exit with the exit code of the command. With --plugin, the command is wrapped with sh to get it, which is not possible if stdout is a terminal.")
 }
 
 func nextExecState(ctx context.Context, ecsClient *ecs.Client, state int, opts ExecCommandOptions) error {
 	switch state {
 	case ui.Cluster:
 		if opts.Cluster != "" {
-			return nextExecState(ctx, ecsClient, ui.Task, opts)
+			return nextExecState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		result, err := ui.AskCluster(ctx, ecsClient, false)
@@ -139,20 +158,53 @@ func nextExecState(ctx context.Context, ecsClient *ecs.Client, state int, opts E
 		}
 
 		opts.Cluster = result
+		return nextExecState(ctx, ecsClient, ui.Service, opts)
+	case ui.Service:
+		if opts.Task != "" {
+			return nextExecState(ctx, ecsClient, ui.Task, opts)
+		}
+		// With --service, the task is chosen automatically if the service has only one running task.
+		if opts.Service != "" {
+			result, err := ui.FindServiceTask(ctx, ecsClient, opts.Cluster, opts.Service)
+			if err != nil {
+				return err
+			}
+
+			opts.Task = result
+			return nextExecState(ctx, ecsClient, ui.Task, opts)
+		}
+
+		result, err := ui.AskService(ctx, ecsClient, opts.Cluster, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			opts.Service = ""
+			return nextExecState(ctx, ecsClient, ui.Cluster, opts)
+		}
+
+		opts.Service = result
 		return nextExecState(ctx, ecsClient, ui.Task, opts)
 	case ui.Task:
 		if opts.Task != "" {
 			return nextExecState(ctx, ecsClient, ui.Container, opts)
 		}
 
-		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, true)
+		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, opts.Service, true)
 		if err != nil {
 			return err
 		}
 		if result == "" {
-			opts.Cluster = ""
 			opts.Task = ""
-			return nextExecState(ctx, ecsClient, ui.Cluster, opts)
+			// The service step is skipped if the cluster has no services
+			if opts.Service == ui.NoServices {
+				opts.Cluster = ""
+				opts.Service = ""
+				return nextExecState(ctx, ecsClient, ui.Cluster, opts)
+			}
+			opts.Service = ""
+			return nextExecState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		opts.Task = result
@@ -182,12 +234,25 @@ func nextExecState(ctx context.Context, ecsClient *ecs.Client, state int, opts E
 }
 
 func startExec(ctx context.Context, ecsClient *ecs.Client, opts ExecCommandOptions) error {
+	var out io.Writer = os.Stdout
+	if opts.Stdout != nil {
+		out = opts.Stdout
+	}
+
+	// The built-in client receives the exit code from the agent.
+	// session-manager-plugin doesn't return it, so the command is wrapped to print it unless the output is the terminal, which the plugin needs for the terminal size.
+	wrap := opts.Plugin != "" && opts.ExitCode && (opts.Stdout != nil || !term.IsTerminal(int(os.Stdout.Fd())))
+	command := opts.Command
+	if wrap {
+		command = wrapCommand(command)
+	}
+
 	execResult, err := ecsClient.ExecuteCommand(ctx, &ecs.ExecuteCommandInput{
 		Cluster:     &opts.Cluster,
 		Task:        &opts.Task,
 		Container:   &opts.Container,
 		Interactive: opts.Interactive,
-		Command:     &opts.Command,
+		Command:     &command,
 	})
 	if err != nil {
 		if opts.EnableErrorChecker {
@@ -212,31 +277,36 @@ func startExec(ctx context.Context, ecsClient *ecs.Client, opts ExecCommandOptio
 		return err
 	}
 
+	if opts.Plugin == "" {
+		code, err := startNativeSession(ctx, execResult.Session, opts.Stdin, out)
+		var unsupportedErr *session.UnsupportedError
+		if errors.As(err, &unsupportedErr) {
+			// The command is not started before the handshake, so it's executed again
+			fmt.Fprintf(os.Stderr, "%s Falling back to session-manager-plugin.\n", err)
+			opts.Plugin = defaultPlugin
+			return startExec(ctx, ecsClient, opts)
+		}
+		if err != nil {
+			return err
+		}
+		if opts.ExitCode && code != 0 {
+			return &util.ExitError{Code: code}
+		}
+
+		return nil
+	}
+
 	sess, err := json.Marshal(execResult.Session)
 	if err != nil {
 		return err
 	}
 
-	describeResult, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
-		Cluster: &opts.Cluster,
-		Tasks:   []string{opts.Task},
-	})
+	sessionTarget, err := getSessionTarget(ctx, ecsClient, opts.Cluster, opts.Task, opts.Container)
 	if err != nil {
 		return err
 	}
-	if len(describeResult.Failures) > 0 {
-		return fmt.Errorf("%v", describeResult.Failures)
-	}
-
-	var runtimeId string
-	for _, c := range describeResult.Tasks[0].Containers {
-		if aws.StringValue(c.Name) != opts.Container {
-			continue
-		}
-		runtimeId = *c.RuntimeId
-	}
 	target, err := json.Marshal(ssm.StartSessionInput{
-		Target: aws.String(fmt.Sprintf("ecs:%s_%s_%s", opts.Cluster, opts.Task, runtimeId)),
+		Target: aws.String(sessionTarget),
 	})
 	if err != nil {
 		return err
@@ -257,10 +327,177 @@ func startExec(ctx context.Context, ecsClient *ecs.Client, opts ExecCommandOptio
 	}()
 	defer close(done)
 
-	err = util.ExecCommand(opts.Plugin, string(sess), opts.Region, "StartSession", opts.Profile, string(target), fmt.Sprintf("https://ecs.%s.amazonaws.com", opts.Region))
+	var stdin io.Reader = os.Stdin
+	if opts.Stdin != nil {
+		stdin = opts.Stdin
+	}
+
+	args := []string{string(sess), opts.Region, "StartSession", opts.Profile, string(target), fmt.Sprintf("https://ecs.%s.amazonaws.com", opts.Region)}
+	if !wrap {
+		return util.ExecCommandWithStdio(stdin, out, opts.Plugin, args...)
+	}
+
+	stdout := &exitCodeWriter{w: out}
+	err = util.ExecCommandWithStdio(stdin, stdout, opts.Plugin, args...)
+	stdout.Flush()
 	if err != nil {
 		return err
 	}
+	if stdout.found && stdout.code != 0 {
+		return &util.ExitError{Code: stdout.code}
+	}
 
 	return nil
 }
+
+// startNativeSession uses the terminal if stdin is nil.
+func startNativeSession(ctx context.Context, sess *types.Session, stdin io.Reader, stdout io.Writer) (int, error) {
+	s, err := session.Open(ctx, aws.StringValue(sess.StreamUrl), aws.StringValue(sess.TokenValue))
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if stdin != nil {
+		return s.Run(ctx, stdin, stdout, os.Stderr)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return 0, err
+		}
+		defer term.Restore(fd, state)
+
+		// Same as session-manager-plugin, check the terminal size periodically.
+		go func() {
+			for {
+				cols, rows, err := term.GetSize(fd)
+				if err == nil {
+					_ = s.SetSize(cols, rows)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(500 * time.Millisecond):
+				}
+			}
+		}()
+	}
+
+	return s.Run(ctx, os.Stdin, stdout, os.Stderr)
+}
+
+// The wrapped command prints its exit code as an OSC sequence, which terminals ignore even if it is not removed.
+const exitCodeSequence = "\x1b]ecsk-exit;"
+
+func wrapCommand(command string) string {
+	return "sh -c " + shellQuote(command+`; printf "\033]ecsk-exit;%d\007" $?`)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// exitCodeWriter removes the exit code sequence from the output and keeps the exit code.
+type exitCodeWriter struct {
+	w       io.Writer
+	pending []byte
+	code    int
+	found   bool
+}
+
+func (w *exitCodeWriter) Write(p []byte) (int, error) {
+	buf := append(w.pending, p...)
+	w.pending = nil
+
+	var out []byte
+	for {
+		i := bytes.Index(buf, []byte(exitCodeSequence))
+		if i < 0 {
+			break
+		}
+
+		end := bytes.IndexByte(buf[i:], '\a')
+		if end < 0 && len(buf)-i < 32 {
+			// Wait for the rest of the sequence
+			out = append(out, buf[:i]...)
+			w.pending = append([]byte{}, buf[i:]...)
+			buf = nil
+			break
+		}
+
+		var code int
+		var err error
+		if end >= 0 {
+			code, err = strconv.Atoi(string(buf[i+len(exitCodeSequence) : i+end]))
+		}
+		if end < 0 || err != nil {
+			// Not the sequence printed by the wrapped command
+			out = append(out, buf[:i+1]...)
+			buf = buf[i+1:]
+			continue
+		}
+
+		w.code = code
+		w.found = true
+		out = append(out, buf[:i]...)
+		buf = buf[i+end+1:]
+	}
+
+	if w.pending == nil {
+		// The end of the output may be the beginning of the sequence
+		for n := len(exitCodeSequence) - 1; n > 0; n-- {
+			if bytes.HasSuffix(buf, []byte(exitCodeSequence[:n])) {
+				w.pending = append([]byte{}, buf[len(buf)-n:]...)
+				buf = buf[:len(buf)-n]
+				break
+			}
+		}
+	}
+
+	out = append(out, buf...)
+	_, err := w.w.Write(out)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *exitCodeWriter) Flush() {
+	_, _ = w.w.Write(w.pending)
+	w.pending = nil
+}
+
+// getSessionTarget returns the Session Manager target of the container, in the form of "ecs:[cluster]_[task]_[runtime_id]".
+func getSessionTarget(ctx context.Context, ecsClient *ecs.Client, cluster string, task string, container string) (string, error) {
+	describeResult, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: &cluster,
+		Tasks:   []string{task},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(describeResult.Failures) > 0 {
+		return "", fmt.Errorf("%v", describeResult.Failures)
+	}
+
+	var runtimeId string
+	for _, c := range describeResult.Tasks[0].Containers {
+		if aws.StringValue(c.Name) != container || c.RuntimeId == nil {
+			continue
+		}
+		runtimeId = *c.RuntimeId
+	}
+	if runtimeId == "" {
+		return "", errors.New("Container not found.")
+	}
+
+	return fmt.Sprintf("ecs:%s_%s_%s", cluster, task, runtimeId), nil
+}
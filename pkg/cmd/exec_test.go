@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExitCodeWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		code   int
+		found  bool
+	}{
+		{
+			name:   "sequence",
+			input:  "hello\n\x1b]ecsk-exit;3\a",
+			output: "hello\n",
+			code:   3,
+			found:  true,
+		},
+		{
+			name:   "output after the sequence",
+			input:  "a\x1b]ecsk-exit;0\ab",
+			output: "ab",
+			code:   0,
+			found:  true,
+		},
+		{
+			name:   "no sequence",
+			input:  "hello\n",
+			output: "hello\n",
+		},
+		{
+			name:   "other OSC sequence",
+			input:  "\x1b]0;title\ahello",
+			output: "\x1b]0;title\ahello",
+		},
+		{
+			name:   "not a number",
+			input:  "\x1b]ecsk-exit;abc\a",
+			output: "\x1b]ecsk-exit;abc\a",
+		},
+		{
+			name:   "unterminated sequence",
+			input:  "\x1b]ecsk-exit;1" + string(bytes.Repeat([]byte("x"), 40)),
+			output: "\x1b]ecsk-exit;1" + string(bytes.Repeat([]byte("x"), 40)),
+		},
+		{
+			name:   "partial prefix at the end",
+			input:  "hello\x1b]ecsk-ex",
+			output: "hello\x1b]ecsk-ex",
+		},
+		{
+			name:   "false match followed by the sequence",
+			input:  "\x1b]ecsk\x1b]ecsk-exit;42\a",
+			output: "\x1b]ecsk",
+			code:   42,
+			found:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		// Every split of the input across writes
+		for size := 1; size <= len(tt.input); size++ {
+			var buf bytes.Buffer
+			w := &exitCodeWriter{w: &buf}
+			for i := 0; i < len(tt.input); i += size {
+				end := i + size
+				if end > len(tt.input) {
+					end = len(tt.input)
+				}
+				n, err := w.Write([]byte(tt.input[i:end]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != end-i {
+					t.Errorf("%s (size %d): Write() = %d, want %d", tt.name, size, n, end-i)
+				}
+			}
+			w.Flush()
+
+			if buf.String() != tt.output {
+				t.Errorf("%s (size %d): output = %q, want %q", tt.name, size, buf.String(), tt.output)
+			}
+			if w.found != tt.found || w.code != tt.code {
+				t.Errorf("%s (size %d): code = %d, %v, want %d, %v", tt.name, size, w.code, w.found, tt.code, tt.found)
+			}
+		}
+	}
+}
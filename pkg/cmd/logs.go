@@ -41,6 +41,7 @@ import (
 
 type LogsCommandOptions struct {
 	Cluster string
+	Service string
 	Tasks   []string
 	Since   string
 	Region  string
@@ -100,6 +101,7 @@ Multiple tasks can be specified.`,
 	rootCmd.AddCommand(logsCmd)
 
 	logsCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The short name or full Amazon Resource Name (ARN) of the cluster that hosts the task.")
+	logsCmd.Flags().StringVar(&opts.Service, "service", "", "The name of the service the tasks belong to. Only the tasks of the service are listed.")
 	logsCmd.Flags().StringSliceVar(&opts.Tasks, "tasks", nil, "The task IDs or full Amazon Resource Name (ARN) of the tasks.")
 	logsCmd.Flags().StringVar(&opts.Since, "since", "5m", "Return logs newer than a relative duration like 52, 2m, or 3h. (From utern)")
 }
@@ -108,7 +110,7 @@ func nextLogsState(ctx context.Context, ecsClient *ecs.Client, state int, opts L
 	switch state {
 	case ui.Cluster:
 		if opts.Cluster != "" {
-			return nextLogsState(ctx, ecsClient, ui.Tasks, opts)
+			return nextLogsState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		result, err := ui.AskCluster(ctx, ecsClient, false)
@@ -120,20 +122,42 @@ func nextLogsState(ctx context.Context, ecsClient *ecs.Client, state int, opts L
 		}
 
 		opts.Cluster = result
+		return nextLogsState(ctx, ecsClient, ui.Service, opts)
+	case ui.Service:
+		if opts.Tasks != nil || opts.Service != "" {
+			return nextLogsState(ctx, ecsClient, ui.Tasks, opts)
+		}
+
+		result, err := ui.AskService(ctx, ecsClient, opts.Cluster, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			return nextLogsState(ctx, ecsClient, ui.Cluster, opts)
+		}
+
+		opts.Service = result
 		return nextLogsState(ctx, ecsClient, ui.Tasks, opts)
 	case ui.Tasks:
 		if opts.Tasks != nil {
 			return nextLogsState(ctx, ecsClient, ui.Complete, opts)
 		}
 
-		result, err := ui.AskTasks(ctx, ecsClient, opts.Cluster)
+		result, err := ui.AskTasks(ctx, ecsClient, opts.Cluster, opts.Service, true)
 		if err != nil {
 			return err
 		}
 		if result == nil {
-			opts.Cluster = ""
 			opts.Tasks = nil
-			return nextLogsState(ctx, ecsClient, ui.Cluster, opts)
+			// The service step is skipped if the cluster has no services
+			if opts.Service == ui.NoServices {
+				opts.Cluster = ""
+				opts.Service = ""
+				return nextLogsState(ctx, ecsClient, ui.Cluster, opts)
+			}
+			opts.Service = ""
+			return nextLogsState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		opts.Tasks = result
@@ -0,0 +1,253 @@
+/*
+Copyright © 2021 yukiarrr
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/spf13/cobra"
+	"github.com/yukiarrr/ecsk/pkg/store"
+	"github.com/yukiarrr/ecsk/pkg/ui"
+	"github.com/yukiarrr/ecsk/pkg/util"
+)
+
+type PortForwardCommandOptions struct {
+	Cluster   string
+	Task      string
+	Container string
+	Ports     []string
+	Plugin    string
+	Region    string
+	Profile   string
+}
+
+func init() {
+	var opts PortForwardCommandOptions
+
+	portForwardCmd := &cobra.Command{
+		Use:   "port-forward",
+		Short: `Forward local ports to a container like "kubectl port-forward"`,
+		Long: `# ecsk port-forward [local_port]:[remote_port]...
+
+After selecting the task and container interactively, forward the local ports to the container until Ctrl-C.
+Multiple port pairs can be specified.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := context.WithCancel(context.Background())
+			util.HandleSignals(cancel)
+
+			region, err := rootCmd.Flags().GetString("region")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			profile, err := rootCmd.Flags().GetString("profile")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			code, err := rootCmd.Flags().GetString("code")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			cfg, err := store.NewConfig(ctx, region, profile, code)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			ecsClient := ecs.NewFromConfig(cfg)
+			ssmClient := ssm.NewFromConfig(cfg)
+			opts.Region = cfg.Region
+			opts.Profile = profile
+
+			if len(args) == 0 {
+				fmt.Fprintln(os.Stderr, `Need port pairs. Try "ecsk port-forward --help".`)
+				os.Exit(1)
+			}
+			opts.Ports = args
+
+			err = nextPortForwardState(ctx, ecsClient, ssmClient, ui.Cluster, opts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(portForwardCmd)
+
+	portForwardCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The short name or full Amazon Resource Name (ARN) of the cluster that hosts the task.")
+	portForwardCmd.Flags().StringVar(&opts.Task, "task", "", "The task ID or full Amazon Resource Name (ARN) of the task.")
+	portForwardCmd.Flags().StringVar(&opts.Container, "container", "", "The name of the container to forward ports to.")
+	portForwardCmd.Flags().StringVar(&opts.Plugin, "plugin", "session-manager-plugin", "Path of session-manager-plugin.")
+}
+
+func nextPortForwardState(ctx context.Context, ecsClient *ecs.Client, ssmClient *ssm.Client, state int, opts PortForwardCommandOptions) error {
+	switch state {
+	case ui.Cluster:
+		if opts.Cluster != "" {
+			return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Task, opts)
+		}
+
+		result, err := ui.AskCluster(ctx, ecsClient, false)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			return errors.New("Canceled.")
+		}
+
+		opts.Cluster = result
+		return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Task, opts)
+	case ui.Task:
+		if opts.Task != "" {
+			return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Container, opts)
+		}
+
+		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, "", true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			opts.Task = ""
+			return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Cluster, opts)
+		}
+
+		opts.Task = result
+		return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Container, opts)
+	case ui.Container:
+		if opts.Container != "" {
+			return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Complete, opts)
+		}
+
+		result, err := ui.AskContainer(ctx, ecsClient, opts.Cluster, opts.Task, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Task = ""
+			opts.Container = ""
+			return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Task, opts)
+		}
+
+		opts.Container = result
+		return nextPortForwardState(ctx, ecsClient, ssmClient, ui.Complete, opts)
+	case ui.Complete:
+		return startPortForward(ctx, ecsClient, ssmClient, opts)
+	}
+
+	return errors.New("Unknown error.")
+}
+
+func startPortForward(ctx context.Context, ecsClient *ecs.Client, ssmClient *ssm.Client, opts PortForwardCommandOptions) error {
+	var inputs []*ssm.StartSessionInput
+	for _, p := range opts.Ports {
+		localPort, remotePort, err := parsePortPair(p)
+		if err != nil {
+			return err
+		}
+
+		inputs = append(inputs, &ssm.StartSessionInput{
+			DocumentName: aws.String("AWS-StartPortForwardingSession"),
+			Parameters: map[string][]string{
+				"portNumber":      {remotePort},
+				"localPortNumber": {localPort},
+			},
+		})
+	}
+
+	target, err := getSessionTarget(ctx, ecsClient, opts.Cluster, opts.Task, opts.Container)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(inputs))
+	for _, input := range inputs {
+		input.Target = aws.String(target)
+
+		go func(input *ssm.StartSessionInput) {
+			errs <- startSession(ctx, ssmClient, input, opts.Plugin, opts.Region, opts.Profile)
+		}(input)
+	}
+
+	// Each session-manager-plugin also receives Ctrl-C, so just wait for all of them to exit.
+	var result error
+	for range inputs {
+		err := <-errs
+		if err != nil && ctx.Err() == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// startSession starts a Session Manager session with the document and parameters of the input, and hands it over to session-manager-plugin.
+func startSession(ctx context.Context, ssmClient *ssm.Client, input *ssm.StartSessionInput, plugin string, region string, profile string) error {
+	sessionResult, err := ssmClient.StartSession(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	sess, err := json.Marshal(sessionResult)
+	if err != nil {
+		return err
+	}
+
+	parameters, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	return util.ExecCommand(plugin, string(sess), region, "StartSession", profile, string(parameters), fmt.Sprintf("https://ssm.%s.amazonaws.com", region))
+}
+
+func parsePortPair(pair string) (string, string, error) {
+	split := strings.Split(pair, ":")
+	if len(split) == 1 {
+		split = append(split, split[0])
+	}
+	if len(split) != 2 {
+		return "", "", fmt.Errorf(`Wrong port format "%s". Try "ecsk port-forward --help".`, pair)
+	}
+
+	for _, p := range split {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return "", "", fmt.Errorf(`Wrong port format "%s". Try "ecsk port-forward --help".`, pair)
+		}
+	}
+
+	return split[0], split[1], nil
+}
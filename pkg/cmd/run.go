@@ -28,12 +28,17 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/kballard/go-shellquote"
 	"github.com/spf13/cobra"
 	"github.com/yukiarrr/ecsk/pkg/store"
 	"github.com/yukiarrr/ecsk/pkg/ui"
@@ -51,15 +56,24 @@ type RunCommandOptions struct {
 	EnableExecuteCommand bool
 	Count                int32
 	Overrides            string
+	AskedOverrides       *types.TaskOverride
+	Env                  []string
+	EnvFiles             []string
+	OverrideCommand      string
+	OverrideContainer    string
 	Rm                   bool
 	Detach               bool
 	Container            string
 	Interactive          bool
+	ExitCode             bool
 	Command              string
 	Plugin               string
 	Region               string
 	Profile              string
 	Code                 string
+	Bastion              bool // Skip the revision and overrides steps, which a bastion task doesn't need
+	TaskDefinitionFlag   bool // The task definition is specified with --task-definition
+	OverrideFlags        bool // Any of --overrides, --env, --env-file and --override-command is specified
 }
 
 func init() {
@@ -71,6 +85,7 @@ func init() {
 		Long: `# ecsk run
 
 If you don't specify any flags, after entering task information interactively, the log will continue to flow until the task is started and stopped as in "docker run".
+After the task is stopped, ecsk exits with the exit code of the essential container.
 
 
 # ecsk run -e -i --rm -c [container_name] -- [command]
@@ -120,25 +135,34 @@ By specifying --rm, the task will be automatically stopped at the end of the ses
 
 			}
 
-			askedOpts, taskIds, err := nextRunState(ctx, ecsClient, ec2Client, ui.LaunchType, opts)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-			}
+			opts.TaskDefinitionFlag = opts.TaskDefinition != ""
+			opts.OverrideFlags = cmd.Flags().Changed("overrides") || len(opts.Env) > 0 || len(opts.EnvFiles) > 0 || opts.OverrideCommand != ""
 
-			if taskIds == nil || !opts.Rm || opts.Detach {
-				return
+			askedOpts, taskIds, runErr := nextRunState(ctx, ecsClient, ec2Client, ui.LaunchType, opts)
+			var exitErr *util.ExitError
+			if runErr != nil && !errors.As(runErr, &exitErr) {
+				fmt.Fprintln(os.Stderr, runErr)
 			}
 
-			ctx, cancel = context.WithCancel(context.Background())
-			util.HandleSignals(cancel)
+			// The tasks are stopped even if waiting for them fails
+			if taskIds != nil && opts.Rm && !opts.Detach {
+				ctx, cancel = context.WithCancel(context.Background())
+				util.HandleSignals(cancel)
 
-			err = startStop(ctx, ecsClient, StopCommandOptions{
-				Cluster: askedOpts.Cluster,
-				Tasks:   taskIds,
-			})
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				err := startStop(ctx, ecsClient, StopCommandOptions{
+					Cluster: askedOpts.Cluster,
+					Tasks:   taskIds,
+				})
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+
+			if exitErr != nil {
+				os.Exit(exitErr.Code)
+			}
+			if runErr != nil {
 				os.Exit(1)
 			}
 		},
@@ -156,11 +180,16 @@ By specifying --rm, the task will be automatically stopped at the end of the ses
 	runCmd.Flags().BoolVarP(&opts.EnableExecuteCommand, "enable-execute-command", "e", false, "Whether or not to enable the execute command functionality for the containers in this task. If true, this enables execute command functionality on all containers in the task. (From AWS CLI)")
 	runCmd.Flags().Int32Var(&opts.Count, "count", 1, "The number of instantiations of the specified task to place on your cluster. You can specify up to 10 tasks per call.	(From AWS CLI)")
 	runCmd.Flags().StringVar(&opts.Overrides, "overrides", "{}", "A list of container overrides in JSON format that specify the name of a container in the specified task definition and the overrides it should receive. You can override the default command for a container (that is specified in the task definition or Docker image) with a command override. You can also override existing environment variables (that are specified in the task definition or Docker image) on a container or add new environment variables to it with an environment override. (From AWS CLI)")
+	runCmd.Flags().StringArrayVar(&opts.Env, "env", nil, `Set the environment variable as KEY=VALUE like "docker run". If = is omitted, the local value is used. Can be specified multiple times.`)
+	runCmd.Flags().StringArrayVar(&opts.EnvFiles, "env-file", nil, "Read the environment variables from the dotenv file. Can be specified multiple times.")
+	runCmd.Flags().StringVar(&opts.OverrideCommand, "override-command", "", "Override the command of the container. The command is split like a shell.")
+	runCmd.Flags().StringVar(&opts.OverrideContainer, "override-container", "", "The name of the container to apply --env, --env-file and --override-command. If not specified, the container of --container is used, and it can be omitted if the task definition has only one container.")
 	runCmd.Flags().BoolVar(&opts.Rm, "rm", false, "When CLI is stoped, tasks are also stoped.")
 	runCmd.Flags().BoolVarP(&opts.Detach, "detach", "d", false, "Do not wait for tasks to start and stop.")
 	runCmd.Flags().StringVarP(&opts.Container, "container", "c", "", "The name of the container to execute the command on. (From AWS CLI)")
 	runCmd.Flags().BoolVarP(&opts.Interactive, "interactive", "i", false, "Use this flag to run your command in interactive mode. (From AWS CLI)")
-	runCmd.Flags().StringVar(&opts.Plugin, "plugin", "session-manager-plugin", "Path of the session-manager-plugin.")
+	runCmd.Flags().BoolVar(&opts.ExitCode, "exit-code", true, "Whether to exit with the exit code of the command. With --plugin, the command is wrapped with sh to get it, which is not possible if stdout is a terminal.")
+	runCmd.Flags().StringVar(&opts.Plugin, "plugin", "", "Path of session-manager-plugin. If not specified, the built-in Session Manager client is used.")
 }
 
 func nextRunState(ctx context.Context, ecsClient *ecs.Client, ec2Client *ec2.Client, state int, opts RunCommandOptions) (RunCommandOptions, []string, error) {
@@ -199,7 +228,10 @@ func nextRunState(ctx context.Context, ecsClient *ecs.Client, ec2Client *ec2.Cli
 		return nextRunState(ctx, ecsClient, ec2Client, ui.Cluster, opts)
 	case ui.TaskDefinition:
 		if opts.TaskDefinition != "" {
-			return nextRunState(ctx, ecsClient, ec2Client, ui.Vpc, opts)
+			if opts.Bastion {
+				return nextRunState(ctx, ecsClient, ec2Client, ui.Vpc, opts)
+			}
+			return nextRunState(ctx, ecsClient, ec2Client, ui.Overrides, opts)
 		}
 
 		result, err := ui.AskTaskDefinition(ctx, ecsClient, true)
@@ -213,6 +245,47 @@ func nextRunState(ctx context.Context, ecsClient *ecs.Client, ec2Client *ec2.Cli
 		}
 
 		opts.TaskDefinition = result
+		if opts.Bastion {
+			return nextRunState(ctx, ecsClient, ec2Client, ui.Vpc, opts)
+		}
+		return nextRunState(ctx, ecsClient, ec2Client, ui.TaskDefinitionRevision, opts)
+	case ui.TaskDefinitionRevision:
+		// The revision is already chosen or specified
+		if strings.Contains(opts.TaskDefinition, ":") {
+			return nextRunState(ctx, ecsClient, ec2Client, ui.Overrides, opts)
+		}
+
+		result, err := ui.AskTaskDefinitionRevision(ctx, ecsClient, opts.TaskDefinition, true)
+		if err != nil {
+			return RunCommandOptions{}, nil, err
+		}
+		if result == "" {
+			opts.TaskDefinition = ""
+			return nextRunState(ctx, ecsClient, ec2Client, ui.TaskDefinition, opts)
+		}
+
+		opts.TaskDefinition = result
+		return nextRunState(ctx, ecsClient, ec2Client, ui.Overrides, opts)
+	case ui.Overrides:
+		if opts.AskedOverrides != nil {
+			return nextRunState(ctx, ecsClient, ec2Client, ui.Vpc, opts)
+		}
+		// Not asked if the overrides are specified with flags, or nothing else is asked, so as not to block scripts
+		if opts.OverrideFlags || (opts.TaskDefinitionFlag && opts.Subnets != nil && opts.SecurityGroups != nil) {
+			return nextRunState(ctx, ecsClient, ec2Client, ui.Vpc, opts)
+		}
+
+		// There is no step to go back to for the specified task definition
+		result, err := ui.AskOverrides(ctx, ecsClient, opts.TaskDefinition, !opts.TaskDefinitionFlag)
+		if err != nil {
+			return RunCommandOptions{}, nil, err
+		}
+		if result == nil {
+			opts.TaskDefinition = taskDefinitionFamily(opts.TaskDefinition)
+			return nextRunState(ctx, ecsClient, ec2Client, ui.TaskDefinitionRevision, opts)
+		}
+
+		opts.AskedOverrides = result
 		return nextRunState(ctx, ecsClient, ec2Client, ui.Vpc, opts)
 	case ui.Vpc:
 		if opts.Vpc != "" || (opts.Subnets != nil && opts.SecurityGroups != nil) {
@@ -224,9 +297,19 @@ func nextRunState(ctx context.Context, ecsClient *ecs.Client, ec2Client *ec2.Cli
 			return RunCommandOptions{}, nil, err
 		}
 		if result == "" {
-			opts.TaskDefinition = ""
 			opts.Vpc = ""
-			return nextRunState(ctx, ecsClient, ec2Client, ui.TaskDefinition, opts)
+			// Go back to the step before the overrides step if it's skipped
+			if opts.Bastion || (opts.OverrideFlags && opts.TaskDefinitionFlag) {
+				opts.TaskDefinition = ""
+				opts.TaskDefinitionFlag = false
+				return nextRunState(ctx, ecsClient, ec2Client, ui.TaskDefinition, opts)
+			}
+			if opts.OverrideFlags {
+				opts.TaskDefinition = taskDefinitionFamily(opts.TaskDefinition)
+				return nextRunState(ctx, ecsClient, ec2Client, ui.TaskDefinitionRevision, opts)
+			}
+			opts.AskedOverrides = nil
+			return nextRunState(ctx, ecsClient, ec2Client, ui.Overrides, opts)
 		}
 
 		opts.Vpc = result
@@ -273,6 +356,175 @@ func nextRunState(ctx context.Context, ecsClient *ecs.Client, ec2Client *ec2.Cli
 	return RunCommandOptions{}, nil, errors.New("Unknown error.")
 }
 
+// taskDefinitionFamily returns the family of "family:revision" or the ARN.
+func taskDefinitionFamily(taskDefinition string) string {
+	family, _, _ := strings.Cut(path.Base(taskDefinition), ":")
+	return family
+}
+
+// mergeOverrides merges o into overrides, and the values of o take precedence.
+// The containers with the same name are merged field by field, and the environment variables are merged by name.
+func mergeOverrides(overrides *types.TaskOverride, o types.TaskOverride) {
+	for _, c := range o.ContainerOverrides {
+		i := -1
+		for j, oc := range overrides.ContainerOverrides {
+			if oc.Name != nil && c.Name != nil && *oc.Name == *c.Name {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			c.Command = append([]string(nil), c.Command...)
+			c.Environment = append([]types.KeyValuePair(nil), c.Environment...)
+			c.EnvironmentFiles = append([]types.EnvironmentFile(nil), c.EnvironmentFiles...)
+			c.ResourceRequirements = append([]types.ResourceRequirement(nil), c.ResourceRequirements...)
+			overrides.ContainerOverrides = append(overrides.ContainerOverrides, c)
+			continue
+		}
+
+		oc := &overrides.ContainerOverrides[i]
+		if c.Command != nil {
+			oc.Command = c.Command
+		}
+		for _, e := range c.Environment {
+			if e.Name != nil && e.Value != nil {
+				oc.Environment = ui.SetEnvironment(oc.Environment, *e.Name, *e.Value)
+			}
+		}
+		for _, f := range c.EnvironmentFiles {
+			if !slices.ContainsFunc(oc.EnvironmentFiles, func(e types.EnvironmentFile) bool {
+				return e.Type == f.Type && aws.ToString(e.Value) == aws.ToString(f.Value)
+			}) {
+				oc.EnvironmentFiles = append(oc.EnvironmentFiles, f)
+			}
+		}
+		if c.Cpu != nil {
+			oc.Cpu = c.Cpu
+		}
+		if c.Memory != nil {
+			oc.Memory = c.Memory
+		}
+		if c.MemoryReservation != nil {
+			oc.MemoryReservation = c.MemoryReservation
+		}
+		// The resource requirements are replaced by type
+		for _, r := range c.ResourceRequirements {
+			j := slices.IndexFunc(oc.ResourceRequirements, func(o types.ResourceRequirement) bool {
+				return o.Type == r.Type
+			})
+			if j < 0 {
+				oc.ResourceRequirements = append(oc.ResourceRequirements, r)
+				continue
+			}
+			oc.ResourceRequirements[j] = r
+		}
+	}
+
+	if o.Cpu != nil {
+		overrides.Cpu = o.Cpu
+	}
+	if o.Memory != nil {
+		overrides.Memory = o.Memory
+	}
+	if o.TaskRoleArn != nil {
+		overrides.TaskRoleArn = o.TaskRoleArn
+	}
+	if o.ExecutionRoleArn != nil {
+		overrides.ExecutionRoleArn = o.ExecutionRoleArn
+	}
+	if o.EphemeralStorage != nil {
+		overrides.EphemeralStorage = o.EphemeralStorage
+	}
+	if o.InferenceAcceleratorOverrides != nil {
+		overrides.InferenceAcceleratorOverrides = o.InferenceAcceleratorOverrides
+	}
+}
+
+// flagOverrides returns the container override of --env, --env-file and --override-command, or nil if they are not specified.
+func (opts RunCommandOptions) flagOverrides(ctx context.Context, ecsClient *ecs.Client) (*types.TaskOverride, error) {
+	if len(opts.Env) == 0 && len(opts.EnvFiles) == 0 && opts.OverrideCommand == "" {
+		return nil, nil
+	}
+
+	result, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &opts.TaskDefinition,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var containers []string
+	for _, c := range result.TaskDefinition.ContainerDefinitions {
+		containers = append(containers, *c.Name)
+	}
+
+	return opts.containerOverrides(containers)
+}
+
+// containerOverrides builds the overrides of the flags for the containers of the task definition.
+func (opts RunCommandOptions) containerOverrides(containers []string) (*types.TaskOverride, error) {
+	var envs []string
+	for _, f := range opts.EnvFiles {
+		e, err := util.ReadEnvFile(f)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, e...)
+	}
+	// Like "docker run", the local value is used for KEY without =, and it's skipped if not set
+	for _, e := range opts.Env {
+		if !strings.Contains(e, "=") {
+			value, ok := os.LookupEnv(e)
+			if !ok {
+				continue
+			}
+			e += "=" + value
+		}
+		envs = append(envs, e)
+	}
+
+	container, err := opts.overrideContainer(containers)
+	if err != nil {
+		return nil, err
+	}
+
+	o := types.ContainerOverride{Name: &container}
+	if opts.OverrideCommand != "" {
+		command, err := shellquote.Split(opts.OverrideCommand)
+		if err != nil {
+			return nil, err
+		}
+		o.Command = command
+	}
+	for _, e := range envs {
+		name, value, _ := strings.Cut(e, "=")
+		o.Environment = ui.SetEnvironment(o.Environment, name, value)
+	}
+
+	return &types.TaskOverride{ContainerOverrides: []types.ContainerOverride{o}}, nil
+}
+
+// overrideContainer returns the container to apply --env, --env-file and --override-command.
+// It's --override-container, the container of --container, or the only container of the task definition.
+func (opts RunCommandOptions) overrideContainer(containers []string) (string, error) {
+	container := opts.OverrideContainer
+	if container == "" {
+		container = opts.Container
+	}
+	if container == "" {
+		if len(containers) != 1 {
+			return "", errors.New("Need --override-container for the task definition with multiple containers.")
+		}
+		return containers[0], nil
+	}
+
+	for _, c := range containers {
+		if c == container {
+			return container, nil
+		}
+	}
+	return "", fmt.Errorf("The container %s doesn't exist in the task definition.", container)
+}
+
 func startRun(ctx context.Context, ecsClient *ecs.Client, opts RunCommandOptions) ([]string, error) {
 	var assignPublicIp types.AssignPublicIp
 	if opts.AssignPublicIp {
@@ -293,6 +545,16 @@ func startRun(ctx context.Context, ecsClient *ecs.Client, opts RunCommandOptions
 	if err != nil {
 		return nil, err
 	}
+	flagOverrides, err := opts.flagOverrides(ctx, ecsClient)
+	if err != nil {
+		return nil, err
+	}
+	if flagOverrides != nil {
+		mergeOverrides(&overrides, *flagOverrides)
+	}
+	if opts.AskedOverrides != nil {
+		mergeOverrides(&overrides, *opts.AskedOverrides)
+	}
 
 	runResult, err := ecsClient.RunTask(ctx, &ecs.RunTaskInput{
 		LaunchType:     launchType,
@@ -325,112 +587,181 @@ func startRun(ctx context.Context, ecsClient *ecs.Client, opts RunCommandOptions
 		return taskIds, nil
 	}
 
-	done := make(chan bool, 1)
-	isExecuting := false
-	executed := make(chan bool, 1)
+	err = waitRun(ctx, ecsClient, opts, taskIds)
+	// The tasks are stopped quietly if canceled with Ctrl-C
+	if ctx.Err() != nil {
+		err = nil
+	}
 
-	go func() {
-		startProgresses := []ui.Progress{
-			{Status: "PROVISIONING", Suffix: " Provisioning...", Completed: fmt.Sprintf("%s Provisioned", ui.Green("✔︎")), PrintError: true},
-			{Status: "PENDING", Suffix: " Pending...", Completed: fmt.Sprintf("%s Pended", ui.Green("✔︎")), PrintError: true},
-			{Status: "ACTIVATING", Suffix: " Activating...", Completed: fmt.Sprintf("%s Activated", ui.Green("✔︎")), PrintError: true},
-		}
+	return taskIds, err
+}
+
+// waitRun waits for the tasks to stop and returns the exit code of the essential container, or executes the command and returns its exit code.
+func waitRun(ctx context.Context, ecsClient *ecs.Client, opts RunCommandOptions, taskIds []string) error {
+	err := waitUntilTasksStarted(ctx, ecsClient, opts.Cluster, taskIds)
+	if err != nil {
+		// Insert line breaks to make the log easier to understand
+		fmt.Println()
+		return err
+	}
 
-		for _, s := range startProgresses {
-			err = ui.PrintTaskProgress(ctx, ecsClient, opts.Cluster, taskIds, s)
+	if opts.Command == "" {
+		go func() {
+			err := startLogs(ctx, ecsClient, LogsCommandOptions{
+				Cluster: opts.Cluster,
+				Tasks:   taskIds,
+				Since:   "5m",
+				Region:  opts.Region,
+				Profile: opts.Profile,
+				Code:    opts.Code,
+			})
 			if err != nil {
-				// Insert line breaks to make the log easier to understand
-				fmt.Println()
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
-				return
+				fmt.Println("Wait until tasks stopped...")
 			}
+		}()
 
+		err := waitUntilTasksStopped(ctx, ecsClient, opts.Cluster, taskIds)
+		if err != nil {
+			return err
+		}
+
+		code, err := printTasksResult(ctx, ecsClient, opts.Cluster, taskIds)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return &util.ExitError{Code: code}
+		}
+
+		return nil
+	}
+
+	fmt.Println("Waiting for the execute command agent...")
+
+	const max = 10
+	for i := 0; ; i++ {
+		err := startExec(ctx, ecsClient, ExecCommandOptions{
+			Cluster:            opts.Cluster,
+			Task:               taskIds[0],
+			Container:          opts.Container,
+			Interactive:        opts.Interactive,
+			Plugin:             opts.Plugin,
+			EnableErrorChecker: false,
+			ExitCode:           opts.ExitCode,
+			Command:            opts.Command,
+			Region:             opts.Region,
+		})
+		if err != nil && i < max-1 && strings.Contains(err.Error(), "the execute command agent isn’t running") {
 			select {
 			case <-ctx.Done():
-				return
-			default:
+				return ctx.Err()
+			case <-time.After(3 * time.Second):
 			}
+			continue
 		}
 
-		fmt.Printf("Tasks started! %s\n", taskIds)
+		return err
+	}
+}
 
-		if opts.Command == "" {
-			go func() {
-				err := startLogs(ctx, ecsClient, LogsCommandOptions{
-					Cluster: opts.Cluster,
-					Tasks:   taskIds,
-					Since:   "5m",
-					Region:  opts.Region,
-					Profile: opts.Profile,
-					Code:    opts.Code,
-				})
-				if err != nil {
-					fmt.Println("Wait until tasks stopped...")
-				}
-			}()
+func waitUntilTasksStarted(ctx context.Context, ecsClient *ecs.Client, cluster string, taskIds []string) error {
+	startProgresses := []ui.Progress{
+		{Status: "PROVISIONING", Suffix: " Provisioning...", Completed: fmt.Sprintf("%s Provisioned", ui.Green("✔︎")), PrintError: true},
+		{Status: "PENDING", Suffix: " Pending...", Completed: fmt.Sprintf("%s Pended", ui.Green("✔︎")), PrintError: true},
+		{Status: "ACTIVATING", Suffix: " Activating...", Completed: fmt.Sprintf("%s Activated", ui.Green("✔︎")), PrintError: true},
+	}
 
-			_ = waitUntilTasksStopped(ctx, ecsClient, opts.Cluster, taskIds)
-		} else {
-			fmt.Println("Waiting for the execute command agent...")
+	for _, s := range startProgresses {
+		err := ui.PrintTaskProgress(ctx, ecsClient, cluster, taskIds, s)
+		if err != nil {
+			return err
+		}
 
-			defer close(executed)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
 
-			const max = 10
-			for i := 0; i < max; i++ {
-				isExecuting = true
+	fmt.Printf("Tasks started! %s\n", taskIds)
 
-				err := startExec(ctx, ecsClient, ExecCommandOptions{
-					Cluster:            opts.Cluster,
-					Task:               taskIds[0],
-					Container:          opts.Container,
-					Interactive:        opts.Interactive,
-					Plugin:             opts.Plugin,
-					EnableErrorChecker: false,
-					Command:            opts.Command,
-					Region:             opts.Region,
-				},
-				)
+	return nil
+}
 
-				isExecuting = false
+func waitUntilTasksStopped(ctx context.Context, ecsClient *ecs.Client, cluster string, taskIds []string) error {
+	return ecs.NewTasksStoppedWaiter(ecsClient).Wait(ctx, &ecs.DescribeTasksInput{
+		Cluster: &cluster,
+		Tasks:   taskIds,
+	}, 30*time.Minute)
+}
 
-				if err != nil {
-					if i < max-1 && strings.Contains(err.Error(), "the execute command agent isn’t running") {
-						select {
-						case <-ctx.Done():
-							return
-						case <-time.After(3 * time.Second):
-						}
-						continue
-					}
+// printTasksResult prints the exit code of each container, and returns the exit code of the essential containers like "docker run".
+func printTasksResult(ctx context.Context, ecsClient *ecs.Client, cluster string, taskIds []string) (int, error) {
+	describeResult, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: &cluster,
+		Tasks:   taskIds,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(describeResult.Failures) > 0 {
+		return 0, fmt.Errorf("%v", describeResult.Failures)
+	}
 
-					fmt.Fprintln(os.Stderr, err)
-					os.Exit(1)
-					return
-				}
+	// Insert line breaks to make the log easier to understand
+	fmt.Println()
 
-				break
+	code := 0
+	essentials := make(map[string]map[string]bool)
+	for _, t := range describeResult.Tasks {
+		taskDefinitionArn := aws.ToString(t.TaskDefinitionArn)
+		if _, ok := essentials[taskDefinitionArn]; !ok {
+			describeTaskDefinitionResult, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+				TaskDefinition: t.TaskDefinitionArn,
+			})
+			if err != nil {
+				return 0, err
+			}
+
+			essentials[taskDefinitionArn] = make(map[string]bool)
+			for _, c := range describeTaskDefinitionResult.TaskDefinition.ContainerDefinitions {
+				// Containers are essential by default
+				essentials[taskDefinitionArn][aws.ToString(c.Name)] = c.Essential == nil || *c.Essential
 			}
 		}
 
-		close(done)
-	}()
+		fmt.Printf("Task %s stopped: %s\n", path.Base(aws.ToString(t.TaskArn)), aws.ToString(t.StoppedReason))
 
-	select {
-	case <-ctx.Done():
-	case <-done:
-	}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, c := range t.Containers {
+			name := aws.ToString(c.Name)
+			essential := essentials[taskDefinitionArn][name]
 
-	if isExecuting {
-		<-executed
-	}
+			mark := ui.Green("✔︎")
+			exitCode := "-"
+			if c.ExitCode != nil {
+				exitCode = strconv.Itoa(int(*c.ExitCode))
+			}
+			if c.ExitCode == nil || *c.ExitCode != 0 {
+				mark = ui.Red("✘")
+				if essential && code == 0 {
+					// Failed to start
+					code = 1
+					if c.ExitCode != nil {
+						code = int(*c.ExitCode)
+					}
+				}
+			}
 
-	return taskIds, nil
-}
+			var label string
+			if essential {
+				label = "essential"
+			}
+			fmt.Fprintf(w, "  %s %s\t%s\texit code %s\t%s\n", mark, name, label, exitCode, aws.ToString(c.Reason))
+		}
+		w.Flush()
+	}
 
-func waitUntilTasksStopped(ctx context.Context, ecsClient *ecs.Client, cluster string, taskIds []string) error {
-	return ecs.NewTasksStoppedWaiter(ecsClient).Wait(ctx, &ecs.DescribeTasksInput{
-		Cluster: &cluster,
-		Tasks:   taskIds,
-	}, 30*time.Minute)
+	return code, nil
 }
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestMergeOverrides(t *testing.T) {
+	env := func(kv ...string) []types.KeyValuePair {
+		var e []types.KeyValuePair
+		for i := 0; i < len(kv); i += 2 {
+			e = append(e, types.KeyValuePair{Name: aws.String(kv[i]), Value: aws.String(kv[i+1])})
+		}
+		return e
+	}
+
+	tests := []struct {
+		name      string
+		overrides types.TaskOverride
+		o         types.TaskOverride
+		want      types.TaskOverride
+	}{
+		{
+			name: "new container",
+			o: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Command: []string{"echo", "a"}, Environment: env("A", "1")},
+			}},
+			want: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Command: []string{"echo", "a"}, Environment: env("A", "1")},
+			}},
+		},
+		{
+			name: "other container is kept",
+			overrides: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("sidecar"), Environment: env("B", "2")},
+			}},
+			o: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Environment: env("A", "1")},
+			}},
+			want: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("sidecar"), Environment: env("B", "2")},
+				{Name: aws.String("app"), Environment: env("A", "1")},
+			}},
+		},
+		{
+			name: "same container",
+			overrides: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Command: []string{"old"}, Environment: env("A", "1", "B", "2")},
+			}},
+			o: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Environment: env("B", "3", "C", "4")},
+			}},
+			want: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Command: []string{"old"}, Environment: env("A", "1", "B", "3", "C", "4")},
+			}},
+		},
+		{
+			name: "command takes precedence",
+			overrides: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Command: []string{"old"}},
+			}},
+			o: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Command: []string{"new"}},
+			}},
+			want: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Command: []string{"new"}},
+			}},
+		},
+		{
+			name: "cleared value",
+			overrides: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Environment: env("A", "1")},
+			}},
+			o: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Environment: env("A", "")},
+			}},
+			want: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Environment: env("A", "")},
+			}},
+		},
+		{
+			name: "other fields are kept",
+			overrides: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{
+					Name:                 aws.String("app"),
+					Cpu:                  aws.Int32(256),
+					Memory:               aws.Int32(512),
+					MemoryReservation:    aws.Int32(128),
+					EnvironmentFiles:     []types.EnvironmentFile{{Type: types.EnvironmentFileTypeS3, Value: aws.String("arn:aws:s3:::bucket/a.env")}},
+					ResourceRequirements: []types.ResourceRequirement{{Type: types.ResourceTypeGpu, Value: aws.String("1")}},
+				},
+			}},
+			o: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Environment: env("A", "1")},
+			}},
+			want: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{
+					Name:                 aws.String("app"),
+					Cpu:                  aws.Int32(256),
+					Memory:               aws.Int32(512),
+					MemoryReservation:    aws.Int32(128),
+					Environment:          env("A", "1"),
+					EnvironmentFiles:     []types.EnvironmentFile{{Type: types.EnvironmentFileTypeS3, Value: aws.String("arn:aws:s3:::bucket/a.env")}},
+					ResourceRequirements: []types.ResourceRequirement{{Type: types.ResourceTypeGpu, Value: aws.String("1")}},
+				},
+			}},
+		},
+		{
+			name: "other fields take precedence",
+			overrides: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{
+					Name:                 aws.String("app"),
+					Cpu:                  aws.Int32(256),
+					Memory:               aws.Int32(512),
+					EnvironmentFiles:     []types.EnvironmentFile{{Type: types.EnvironmentFileTypeS3, Value: aws.String("arn:aws:s3:::bucket/a.env")}},
+					ResourceRequirements: []types.ResourceRequirement{{Type: types.ResourceTypeGpu, Value: aws.String("1")}},
+				},
+			}},
+			o: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{
+					Name:                 aws.String("app"),
+					Cpu:                  aws.Int32(1024),
+					EnvironmentFiles:     []types.EnvironmentFile{{Type: types.EnvironmentFileTypeS3, Value: aws.String("arn:aws:s3:::bucket/b.env")}},
+					ResourceRequirements: []types.ResourceRequirement{{Type: types.ResourceTypeGpu, Value: aws.String("2")}},
+				},
+			}},
+			want: types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+				{
+					Name:   aws.String("app"),
+					Cpu:    aws.Int32(1024),
+					Memory: aws.Int32(512),
+					EnvironmentFiles: []types.EnvironmentFile{
+						{Type: types.EnvironmentFileTypeS3, Value: aws.String("arn:aws:s3:::bucket/a.env")},
+						{Type: types.EnvironmentFileTypeS3, Value: aws.String("arn:aws:s3:::bucket/b.env")},
+					},
+					ResourceRequirements: []types.ResourceRequirement{{Type: types.ResourceTypeGpu, Value: aws.String("2")}},
+				},
+			}},
+		},
+		{
+			name:      "task values",
+			overrides: types.TaskOverride{Cpu: aws.String("256"), Memory: aws.String("512")},
+			o:         types.TaskOverride{Cpu: aws.String("1024"), EphemeralStorage: &types.EphemeralStorage{SizeInGiB: 30}},
+			want:      types.TaskOverride{Cpu: aws.String("1024"), Memory: aws.String("512"), EphemeralStorage: &types.EphemeralStorage{SizeInGiB: 30}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mergeOverrides(&tt.overrides, tt.o)
+			if !reflect.DeepEqual(tt.overrides, tt.want) {
+				t.Errorf("mergeOverrides() = %+v, want %+v", tt.overrides, tt.want)
+			}
+		})
+	}
+}
+
+// The overrides of the flags are merged first, and the asked overrides take precedence
+func TestMergeOverridesFlagsAndAsked(t *testing.T) {
+	var overrides types.TaskOverride
+	flag := types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+		{Name: aws.String("app"), Command: []string{"flag"}, Environment: []types.KeyValuePair{{Name: aws.String("A"), Value: aws.String("flag")}}},
+	}}
+	mergeOverrides(&overrides, flag)
+	asked := types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+		{Name: aws.String("app"), Environment: []types.KeyValuePair{{Name: aws.String("A"), Value: aws.String("asked")}}},
+	}}
+	mergeOverrides(&overrides, asked)
+
+	if len(overrides.ContainerOverrides) != 1 {
+		t.Fatalf("len(ContainerOverrides) = %d, want 1", len(overrides.ContainerOverrides))
+	}
+	c := overrides.ContainerOverrides[0]
+	if !reflect.DeepEqual(c.Command, []string{"flag"}) {
+		t.Errorf("Command = %q, want the command of the flag", c.Command)
+	}
+	if len(c.Environment) != 1 || *c.Environment[0].Value != "asked" {
+		t.Errorf("Environment = %+v, want A=asked", c.Environment)
+	}
+	// The merged overrides don't share the slices with the overrides of the flags
+	if *flag.ContainerOverrides[0].Environment[0].Value != "flag" {
+		t.Errorf("the overrides of the flags are modified")
+	}
+}
+
+func TestOverrideContainer(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       RunCommandOptions
+		containers []string
+		want       string
+		wantErr    bool
+	}{
+		{name: "only container", containers: []string{"app"}, want: "app"},
+		{name: "multiple containers", containers: []string{"app", "sidecar"}, wantErr: true},
+		{name: "override container", opts: RunCommandOptions{OverrideContainer: "sidecar"}, containers: []string{"app", "sidecar"}, want: "sidecar"},
+		{name: "exec container", opts: RunCommandOptions{Container: "sidecar"}, containers: []string{"app", "sidecar"}, want: "sidecar"},
+		{name: "override container takes precedence", opts: RunCommandOptions{OverrideContainer: "app", Container: "sidecar"}, containers: []string{"app", "sidecar"}, want: "app"},
+		{name: "missing container", opts: RunCommandOptions{OverrideContainer: "db"}, containers: []string{"app"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opts.overrideContainer(tt.containers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("overrideContainer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("overrideContainer() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerOverrides(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envFile, []byte("A=file\nB=file\nB=file2\nC=file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ECSK_TEST_LOCAL", "local")
+
+	tests := []struct {
+		name       string
+		opts       RunCommandOptions
+		containers []string
+		want       *types.ContainerOverride
+		wantErr    bool
+	}{
+		{
+			name:       "env",
+			opts:       RunCommandOptions{Env: []string{"A=1", "B=2"}},
+			containers: []string{"app"},
+			want:       &types.ContainerOverride{Name: aws.String("app"), Environment: []types.KeyValuePair{{Name: aws.String("A"), Value: aws.String("1")}, {Name: aws.String("B"), Value: aws.String("2")}}},
+		},
+		{
+			name:       "duplicate key",
+			opts:       RunCommandOptions{Env: []string{"A=1", "A=2"}},
+			containers: []string{"app"},
+			want:       &types.ContainerOverride{Name: aws.String("app"), Environment: []types.KeyValuePair{{Name: aws.String("A"), Value: aws.String("2")}}},
+		},
+		{
+			name:       "env takes precedence over env file",
+			opts:       RunCommandOptions{EnvFiles: []string{envFile}, Env: []string{"A=flag", "C="}},
+			containers: []string{"app"},
+			want: &types.ContainerOverride{Name: aws.String("app"), Environment: []types.KeyValuePair{
+				{Name: aws.String("A"), Value: aws.String("flag")},
+				{Name: aws.String("B"), Value: aws.String("file2")},
+				{Name: aws.String("C"), Value: aws.String("")},
+			}},
+		},
+		{
+			name:       "local value",
+			opts:       RunCommandOptions{Env: []string{"ECSK_TEST_LOCAL", "ECSK_TEST_UNSET"}},
+			containers: []string{"app"},
+			want:       &types.ContainerOverride{Name: aws.String("app"), Environment: []types.KeyValuePair{{Name: aws.String("ECSK_TEST_LOCAL"), Value: aws.String("local")}}},
+		},
+		{
+			name:       "command",
+			opts:       RunCommandOptions{OverrideContainer: "sidecar", OverrideCommand: `sh -c "echo a"`},
+			containers: []string{"app", "sidecar"},
+			want:       &types.ContainerOverride{Name: aws.String("sidecar"), Command: []string{"sh", "-c", "echo a"}},
+		},
+		{
+			name:       "missing override container",
+			opts:       RunCommandOptions{Env: []string{"A=1"}, OverrideContainer: "db"},
+			containers: []string{"app", "sidecar"},
+			wantErr:    true,
+		},
+		{
+			name:       "missing exec container",
+			opts:       RunCommandOptions{Env: []string{"A=1"}, Container: "db"},
+			containers: []string{"app"},
+			wantErr:    true,
+		},
+		{
+			name:       "missing env file",
+			opts:       RunCommandOptions{EnvFiles: []string{filepath.Join(t.TempDir(), "missing.env")}},
+			containers: []string{"app"},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opts.containerOverrides(tt.containers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("containerOverrides() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got.ContainerOverrides) != 1 || !reflect.DeepEqual(got.ContainerOverrides[0], *tt.want) {
+				t.Errorf("containerOverrides() = %+v, want %+v", got.ContainerOverrides, *tt.want)
+			}
+		})
+	}
+}
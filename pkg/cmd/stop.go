@@ -38,6 +38,7 @@ import (
 
 type StopCommandOptions struct {
 	Cluster string
+	Service string
 	Tasks   []string
 }
 
@@ -89,6 +90,7 @@ After selecting the task interactively, stop.`,
 	rootCmd.AddCommand(stopCmd)
 
 	stopCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The short name or full Amazon Resource Name (ARN) of the cluster that hosts the task to stop. (From AWS CLI)")
+	stopCmd.Flags().StringVar(&opts.Service, "service", "", "The name of the service the tasks belong to. Only the tasks of the service are listed.")
 	stopCmd.Flags().StringSliceVar(&opts.Tasks, "tasks", nil, "The task IDs or full Amazon Resource Name (ARN) of the tasks to stop. (From AWS CLI)")
 }
 
@@ -96,7 +98,7 @@ func nextStopState(ctx context.Context, ecsClient *ecs.Client, state int, opts S
 	switch state {
 	case ui.Cluster:
 		if opts.Cluster != "" {
-			return nextStopState(ctx, ecsClient, ui.Tasks, opts)
+			return nextStopState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		result, err := ui.AskCluster(ctx, ecsClient, false)
@@ -108,20 +110,42 @@ func nextStopState(ctx context.Context, ecsClient *ecs.Client, state int, opts S
 		}
 
 		opts.Cluster = result
+		return nextStopState(ctx, ecsClient, ui.Service, opts)
+	case ui.Service:
+		if opts.Tasks != nil || opts.Service != "" {
+			return nextStopState(ctx, ecsClient, ui.Tasks, opts)
+		}
+
+		result, err := ui.AskService(ctx, ecsClient, opts.Cluster, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			return nextStopState(ctx, ecsClient, ui.Cluster, opts)
+		}
+
+		opts.Service = result
 		return nextStopState(ctx, ecsClient, ui.Tasks, opts)
 	case ui.Tasks:
 		if opts.Tasks != nil {
 			return nextStopState(ctx, ecsClient, ui.Complete, opts)
 		}
 
-		result, err := ui.AskTasks(ctx, ecsClient, opts.Cluster)
+		result, err := ui.AskTasks(ctx, ecsClient, opts.Cluster, opts.Service, false)
 		if err != nil {
 			return err
 		}
 		if result == nil {
-			opts.Cluster = ""
 			opts.Tasks = nil
-			return nextStopState(ctx, ecsClient, ui.Cluster, opts)
+			// The service step is skipped if the cluster has no services
+			if opts.Service == ui.NoServices {
+				opts.Cluster = ""
+				opts.Service = ""
+				return nextStopState(ctx, ecsClient, ui.Cluster, opts)
+			}
+			opts.Service = ""
+			return nextStopState(ctx, ecsClient, ui.Service, opts)
 		}
 
 		opts.Tasks = result
@@ -0,0 +1,454 @@
+/*
+Copyright © 2021 yukiarrr
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	"github.com/yukiarrr/ecsk/pkg/store"
+	"github.com/yukiarrr/ecsk/pkg/ui"
+	"github.com/yukiarrr/ecsk/pkg/util"
+)
+
+// syncDelay is the time to wait for the changes to settle before pushing them in watch mode.
+const syncDelay = 500 * time.Millisecond
+
+type SyncCommandOptions struct {
+	Cluster     string
+	Task        string
+	Container   string
+	Bucket      string
+	Src         string
+	Dst         string
+	Include     []string
+	Exclude     []string
+	Watch       bool
+	SSE         string
+	SSEKMSKeyID string
+	BucketOwner string
+	Region      string
+	Profile     string
+}
+
+func init() {
+	var opts SyncCommandOptions
+
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: `Sync a local directory into a container like "rsync"`,
+		Long: `# ecsk sync ./src [container_name]:/app/src
+
+After selecting the task interactively, compare the SHA-256 checksums of the files in the local and remote directories,
+and transfer only the changed files through the S3 Bucket. The files which don't exist in the local directory are deleted from the remote directory.
+The task can also be specified before the container name like "ecsk cp".
+
+
+# ecsk sync --watch --exclude node_modules ./src [container_name]:/app/src
+
+After the first sync, watch the local directory and push the changes continuously until Ctrl-C.
+The changes made in the container during watching are not detected.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := context.WithCancel(context.Background())
+			util.HandleSignals(cancel)
+
+			region, err := rootCmd.Flags().GetString("region")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			profile, err := rootCmd.Flags().GetString("profile")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			code, err := rootCmd.Flags().GetString("code")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			cfg, err := store.NewConfig(ctx, region, profile, code)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			err = opts.cpOptions().bucketOptions().Validate()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			ecsClient := ecs.NewFromConfig(cfg)
+			s3Client := s3.NewFromConfig(cfg, store.WithBucketOptions(opts.cpOptions().bucketOptions()))
+			opts.Region = cfg.Region
+			opts.Profile = profile
+
+			if len(args) != 2 {
+				fmt.Fprintln(os.Stderr, `Wrong format. Try "ecsk sync --help".`)
+				os.Exit(1)
+			}
+
+			src := parseCpPath(args[0])
+			dst := parseCpPath(args[1])
+			if src.remote || src.s3 || !dst.remote {
+				fmt.Fprintln(os.Stderr, `Only a local directory can be synced into a container. Try "ecsk sync --help".`)
+				os.Exit(1)
+			}
+			if !filepath.IsAbs(dst.path) {
+				fmt.Fprintln(os.Stderr, `The remote path must be absolute. Try "ecsk sync --help".`)
+				os.Exit(1)
+			}
+			info, err := os.Stat(src.path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if !info.IsDir() {
+				fmt.Fprintf(os.Stderr, "%s is not a directory.\n", src.path)
+				os.Exit(1)
+			}
+			if dst.task != "" {
+				opts.Task = dst.task
+			}
+			if dst.container != "" {
+				opts.Container = dst.container
+			}
+			opts.Src = src.path
+			opts.Dst = dst.path
+			_, err = store.NewFilter(opts.Include, opts.Exclude)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			err = nextSyncState(ctx, ecsClient, s3Client, ui.Cluster, opts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The short name or full Amazon Resource Name (ARN) of the cluster that hosts the task.")
+	syncCmd.Flags().StringVar(&opts.Task, "task", "", "The task ID or full Amazon Resource Name (ARN) of the task.")
+	syncCmd.Flags().StringVar(&opts.Container, "container", "", "The name of the container to sync files.")
+	syncCmd.Flags().StringVar(&opts.Bucket, "bucket", "", "The bucket to use for file transfer.")
+	syncCmd.Flags().StringArrayVar(&opts.Include, "include", nil, "Sync only the files matching the gitignore-style pattern. Can be specified multiple times.")
+	syncCmd.Flags().StringArrayVar(&opts.Exclude, "exclude", nil, "Don't sync the files matching the gitignore-style pattern. Can be specified multiple times.")
+	syncCmd.Flags().StringVar(&opts.SSE, "sse", "", `The server-side encryption of the uploaded objects. The accepted values are "AES256", "aws:kms" and "aws:kms:dsse".`)
+	syncCmd.Flags().StringVar(&opts.SSEKMSKeyID, "sse-kms-key-id", "", "The ID of the KMS key for the server-side encryption. If specified without --sse, aws:kms is used.")
+	syncCmd.Flags().StringVar(&opts.BucketOwner, "expected-bucket-owner", "", "The account ID of the expected bucket owner. The requests fail if the bucket is owned by another account.")
+	syncCmd.Flags().BoolVarP(&opts.Watch, "watch", "w", false, "Watch the local directory and push the changes until Ctrl-C.")
+}
+
+func nextSyncState(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, state int, opts SyncCommandOptions) error {
+	switch state {
+	case ui.Cluster:
+		if opts.Cluster != "" {
+			return nextSyncState(ctx, ecsClient, s3Client, ui.Task, opts)
+		}
+
+		result, err := ui.AskCluster(ctx, ecsClient, false)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			return errors.New("Canceled.")
+		}
+
+		opts.Cluster = result
+		return nextSyncState(ctx, ecsClient, s3Client, ui.Task, opts)
+	case ui.Task:
+		if opts.Task != "" {
+			return nextSyncState(ctx, ecsClient, s3Client, ui.Container, opts)
+		}
+
+		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, "", true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			opts.Task = ""
+			return nextSyncState(ctx, ecsClient, s3Client, ui.Cluster, opts)
+		}
+
+		opts.Task = result
+		return nextSyncState(ctx, ecsClient, s3Client, ui.Container, opts)
+	case ui.Container:
+		if opts.Container != "" {
+			return nextSyncState(ctx, ecsClient, s3Client, ui.Bucket, opts)
+		}
+
+		result, err := ui.AskContainer(ctx, ecsClient, opts.Cluster, opts.Task, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Task = ""
+			opts.Container = ""
+			return nextSyncState(ctx, ecsClient, s3Client, ui.Task, opts)
+		}
+
+		opts.Container = result
+		return nextSyncState(ctx, ecsClient, s3Client, ui.Bucket, opts)
+	case ui.Bucket:
+		if opts.Bucket != "" {
+			return nextSyncState(ctx, ecsClient, s3Client, ui.Complete, opts)
+		}
+
+		result, err := ui.AskBucket(ctx, s3Client, opts.Region, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Container = ""
+			opts.Bucket = ""
+			return nextSyncState(ctx, ecsClient, s3Client, ui.Container, opts)
+		}
+
+		opts.Bucket = result
+		return nextSyncState(ctx, ecsClient, s3Client, ui.Complete, opts)
+	case ui.Complete:
+		return startSync(ctx, ecsClient, s3Client, opts)
+	}
+
+	return errors.New("Unknown error.")
+}
+
+func startSync(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts SyncCommandOptions) error {
+	filter, err := store.NewFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	cpOpts := opts.cpOptions()
+	helperPath, err := installCpHelper(ctx, ecsClient, cpOpts)
+	if err != nil {
+		return err
+	}
+
+	remote, err := fetchManifest(ctx, ecsClient, cpOpts, helperPath, opts.Dst)
+	if err != nil {
+		return err
+	}
+	local, err := store.NewManifest(opts.Src, filter, nil)
+	if err != nil {
+		return err
+	}
+
+	err = pushChanges(ctx, ecsClient, s3Client, cpOpts, helperPath, local, remote)
+	if err != nil || !opts.Watch {
+		return err
+	}
+
+	return watchChanges(ctx, ecsClient, s3Client, cpOpts, helperPath, filter, local)
+}
+
+// watchChanges pushes the changes of the local directory until the context is canceled.
+// The synced manifest is updated only after a successful push, so that the failed changes are pushed again with the next changes.
+func watchChanges(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts CpCommandOptions, helperPath string, filter *store.Filter, synced store.Manifest) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = addWatches(watcher, opts.Src, opts.Src, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Watching for changes. Press Ctrl-C to stop.")
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			// New directories are not watched automatically.
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					err := addWatches(watcher, opts.Src, event.Name, filter)
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+				}
+			}
+			timer = time.After(syncDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintln(os.Stderr, err)
+		case <-timer:
+			timer = nil
+
+			local, err := store.NewManifest(opts.Src, filter, synced)
+			if err == nil {
+				err = pushChanges(ctx, ecsClient, s3Client, opts, helperPath, local, synced)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			synced = local
+		}
+	}
+}
+
+// addWatches watches dir and the directories in it, except the excluded ones.
+func addWatches(watcher *fsnotify.Watcher, root string, dir string, filter *store.Filter) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && filter.Skip(filepath.ToSlash(rel)) {
+			return filepath.SkipDir
+		}
+
+		return watcher.Add(path)
+	})
+}
+
+// pushChanges transfers the files which differ between the manifests, and deletes the files only in the remote manifest.
+func pushChanges(ctx context.Context, ecsClient *ecs.Client, s3Client *s3.Client, opts CpCommandOptions, helperPath string, local store.Manifest, remote store.Manifest) error {
+	changed, deleted := local.Diff(remote)
+	if len(changed) == 0 && len(deleted) == 0 {
+		fmt.Println("Already up to date.")
+		return nil
+	}
+
+	// Milliseconds are added, because the changes can be pushed several times a second in watch mode.
+	t := time.Now()
+	key := fmt.Sprintf("%s%s%03d", store.TransferPrefix, t.Format("20060102150405"), t.Nanosecond()/int(time.Millisecond))
+
+	keys, err := store.UploadFiles(ctx, s3Client, opts.Bucket, key, opts.Src, changed)
+	if err == nil && len(deleted) > 0 {
+		err = store.PutDeletions(ctx, s3Client, opts.Bucket, key, deleted)
+		if err == nil {
+			keys = append(keys, store.DeletionsKey(key))
+		}
+	}
+	if err == nil {
+		err = startCpHelper(ctx, ecsClient, opts, helperCommand(helperPath, opts, "sync", opts.Bucket, key, filepath.ToSlash(opts.Dst)))
+	}
+
+	// The objects are deleted even if the sync failed, because the next sync compares the files again.
+	var safeKeys []string
+	for _, k := range keys {
+		// Safety
+		if !strings.Contains(k, key) {
+			continue
+		}
+		safeKeys = append(safeKeys, k)
+	}
+	deleteErr := store.DeleteKeys(ctx, s3Client, opts.Bucket, safeKeys)
+	if err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// fetchManifest runs the cp helper in the container to read the manifest of dir through the terminal.
+func fetchManifest(ctx context.Context, ecsClient *ecs.Client, opts CpCommandOptions, helperPath string, dir string) (store.Manifest, error) {
+	var buf bytes.Buffer
+	w := &execTransferWriter{data: &buf, other: os.Stderr}
+
+	err := startExec(ctx, ecsClient, ExecCommandOptions{
+		Cluster:            opts.Cluster,
+		Task:               opts.Task,
+		Container:          opts.Container,
+		Interactive:        true,
+		EnableErrorChecker: false,
+		ExitCode:           true,
+		Command:            helperCommand(helperPath, opts, "manifest", filepath.ToSlash(dir)),
+		Stdin:              strings.NewReader(""),
+		Stdout:             w,
+		Region:             opts.Region,
+		Profile:            opts.Profile,
+	})
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var m store.Manifest
+	b, err := base64.StdEncoding.DecodeString(buf.String())
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the files in the container: %w", err)
+	}
+
+	return m, nil
+}
+
+func (opts SyncCommandOptions) cpOptions() CpCommandOptions {
+	return CpCommandOptions{
+		Cluster:     opts.Cluster,
+		Task:        opts.Task,
+		Container:   opts.Container,
+		Bucket:      opts.Bucket,
+		Src:         opts.Src,
+		Dst:         opts.Dst,
+		FromLocal:   true,
+		Include:     opts.Include,
+		Exclude:     opts.Exclude,
+		SSE:         opts.SSE,
+		SSEKMSKeyID: opts.SSEKMSKeyID,
+		BucketOwner: opts.BucketOwner,
+		Region:      opts.Region,
+		Profile:     opts.Profile,
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright © 2021 yukiarrr
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2/terminal"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/spf13/cobra"
+	"github.com/yukiarrr/ecsk/pkg/store"
+	"github.com/yukiarrr/ecsk/pkg/ui"
+	"github.com/yukiarrr/ecsk/pkg/util"
+)
+
+type TunnelCommandOptions struct {
+	Cluster        string
+	Task           string
+	Container      string
+	RemoteHost     string
+	LocalPort      int
+	Rm             bool
+	LaunchType     string
+	TaskDefinition string
+	Vpc            string
+	Subnets        []string
+	SecurityGroups []string
+	AssignPublicIp bool
+	Plugin         string
+	Region         string
+	Profile        string
+}
+
+func init() {
+	var opts TunnelCommandOptions
+
+	tunnelCmd := &cobra.Command{
+		Use:   "tunnel",
+		Short: "Tunnel to a remote host through a task",
+		Long: `# ecsk tunnel --remote-host [host]:[port] --local-port [local_port]
+
+After selecting the task and container interactively, forward the local port to the remote host through the task until Ctrl-C.
+It can be used to reach private resources such as RDS or ElastiCache.
+
+
+# ecsk tunnel --rm --remote-host [host]:[port] --local-port [local_port]
+
+After entering task information interactively like "ecsk run", a bastion task is started and tunnelled through.
+The task will be automatically stopped when the tunnel is closed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ctx, cancel := context.WithCancel(context.Background())
+			util.HandleSignals(cancel)
+
+			region, err := rootCmd.Flags().GetString("region")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			profile, err := rootCmd.Flags().GetString("profile")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			code, err := rootCmd.Flags().GetString("code")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			cfg, err := store.NewConfig(ctx, region, profile, code)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			ecsClient := ecs.NewFromConfig(cfg)
+			ec2Client := ec2.NewFromConfig(cfg)
+			ssmClient := ssm.NewFromConfig(cfg)
+			opts.Region = cfg.Region
+			opts.Profile = profile
+
+			if opts.RemoteHost == "" {
+				fmt.Fprintln(os.Stderr, `Need --remote-host. Try "ecsk tunnel --help".`)
+				os.Exit(1)
+			}
+
+			if !opts.Rm {
+				err = nextTunnelState(ctx, ecsClient, ssmClient, ui.Cluster, opts)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				return
+			}
+
+			askedOpts, taskIds, err := nextRunState(ctx, ecsClient, ec2Client, ui.LaunchType, RunCommandOptions{
+				LaunchType:           opts.LaunchType,
+				Cluster:              opts.Cluster,
+				TaskDefinition:       opts.TaskDefinition,
+				Vpc:                  opts.Vpc,
+				Subnets:              opts.Subnets,
+				SecurityGroups:       opts.SecurityGroups,
+				AssignPublicIp:       opts.AssignPublicIp,
+				EnableExecuteCommand: true,
+				Count:                1,
+				Overrides:            "{}",
+				Detach:               true,
+				Bastion:              true,
+				Region:               opts.Region,
+				Profile:              opts.Profile,
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			opts.Cluster = askedOpts.Cluster
+			opts.Task = taskIds[0]
+			tunnelErr := startBastionTunnel(ctx, ecsClient, ssmClient, opts)
+			if tunnelErr != nil {
+				fmt.Fprintln(os.Stderr, tunnelErr)
+			}
+
+			ctx, cancel = context.WithCancel(context.Background())
+			util.HandleSignals(cancel)
+
+			err = startStop(ctx, ecsClient, StopCommandOptions{
+				Cluster: askedOpts.Cluster,
+				Tasks:   taskIds,
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if tunnelErr != nil {
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(tunnelCmd)
+
+	tunnelCmd.Flags().StringVar(&opts.Cluster, "cluster", "", "The short name or full Amazon Resource Name (ARN) of the cluster that hosts the task.")
+	tunnelCmd.Flags().StringVar(&opts.Task, "task", "", "The task ID or full Amazon Resource Name (ARN) of the task.")
+	tunnelCmd.Flags().StringVar(&opts.Container, "container", "", "The name of the container to tunnel through.")
+	tunnelCmd.Flags().StringVar(&opts.RemoteHost, "remote-host", "", "The remote host and port to tunnel to, in the format host:port.")
+	tunnelCmd.Flags().IntVar(&opts.LocalPort, "local-port", 0, "The local port to listen on. Defaults to the port of --remote-host.")
+	tunnelCmd.Flags().BoolVar(&opts.Rm, "rm", false, `Start a bastion task like "ecsk run", and stop it when the tunnel is closed.`)
+	tunnelCmd.Flags().StringVar(&opts.LaunchType, "launch-type", "", "The launch type on which to run the bastion task. The accepted values are FARGATE and EC2. (From AWS CLI)")
+	tunnelCmd.Flags().StringVar(&opts.TaskDefinition, "task-definition", "", "The family and revision (family:revision) or full ARN of the task definition to run as the bastion task. (From AWS CLI)")
+	tunnelCmd.Flags().StringVar(&opts.Vpc, "vpc", "", "Filtering subnets and security groups.")
+	tunnelCmd.Flags().StringSliceVar(&opts.Subnets, "subnets", nil, "The IDs of the subnets associated with the bastion task. (From AWS CLI)")
+	tunnelCmd.Flags().StringSliceVar(&opts.SecurityGroups, "security-groups", nil, "The IDs of the security groups associated with the bastion task. (From AWS CLI)")
+	tunnelCmd.Flags().BoolVar(&opts.AssignPublicIp, "assign-public-ip", false, "Whether the bastion task's elastic network interface receives a public IP address. (From AWS CLI)")
+	tunnelCmd.Flags().StringVar(&opts.Plugin, "plugin", "session-manager-plugin", "Path of session-manager-plugin.")
+}
+
+func nextTunnelState(ctx context.Context, ecsClient *ecs.Client, ssmClient *ssm.Client, state int, opts TunnelCommandOptions) error {
+	switch state {
+	case ui.Cluster:
+		if opts.Cluster != "" {
+			return nextTunnelState(ctx, ecsClient, ssmClient, ui.Task, opts)
+		}
+
+		result, err := ui.AskCluster(ctx, ecsClient, false)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			return errors.New("Canceled.")
+		}
+
+		opts.Cluster = result
+		return nextTunnelState(ctx, ecsClient, ssmClient, ui.Task, opts)
+	case ui.Task:
+		if opts.Task != "" {
+			return nextTunnelState(ctx, ecsClient, ssmClient, ui.Container, opts)
+		}
+
+		result, err := ui.AskTask(ctx, ecsClient, opts.Cluster, "", true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Cluster = ""
+			opts.Task = ""
+			return nextTunnelState(ctx, ecsClient, ssmClient, ui.Cluster, opts)
+		}
+
+		opts.Task = result
+		return nextTunnelState(ctx, ecsClient, ssmClient, ui.Container, opts)
+	case ui.Container:
+		if opts.Container != "" {
+			return nextTunnelState(ctx, ecsClient, ssmClient, ui.Complete, opts)
+		}
+
+		result, err := ui.AskContainer(ctx, ecsClient, opts.Cluster, opts.Task, true)
+		if err != nil {
+			return err
+		}
+		if result == "" {
+			opts.Task = ""
+			opts.Container = ""
+			return nextTunnelState(ctx, ecsClient, ssmClient, ui.Task, opts)
+		}
+
+		opts.Container = result
+		return nextTunnelState(ctx, ecsClient, ssmClient, ui.Complete, opts)
+	case ui.Complete:
+		return startTunnel(ctx, ecsClient, ssmClient, opts)
+	}
+
+	return errors.New("Unknown error.")
+}
+
+func startBastionTunnel(ctx context.Context, ecsClient *ecs.Client, ssmClient *ssm.Client, opts TunnelCommandOptions) error {
+	// Canceled with Ctrl-C while starting, and the task is stopped by the caller
+	err := waitUntilTasksStarted(ctx, ecsClient, opts.Cluster, []string{opts.Task})
+	if err != nil && ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.Container == "" {
+		opts.Container, err = ui.AskContainer(ctx, ecsClient, opts.Cluster, opts.Task, false)
+		if errors.Is(err, terminal.InterruptErr) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Waiting for the execute command agent...")
+
+	const max = 10
+	for i := 0; i < max; i++ {
+		err = startTunnel(ctx, ecsClient, ssmClient, opts)
+		if err != nil && i < max-1 && strings.Contains(err.Error(), "TargetNotConnected") {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(3 * time.Second):
+			}
+			continue
+		}
+
+		break
+	}
+
+	return err
+}
+
+func startTunnel(ctx context.Context, ecsClient *ecs.Client, ssmClient *ssm.Client, opts TunnelCommandOptions) error {
+	host, port, err := net.SplitHostPort(opts.RemoteHost)
+	if err != nil {
+		return fmt.Errorf(`Wrong remote host format "%s". Try "ecsk tunnel --help".`, opts.RemoteHost)
+	}
+
+	localPort := port
+	if opts.LocalPort != 0 {
+		localPort = strconv.Itoa(opts.LocalPort)
+	}
+
+	target, err := getSessionTarget(ctx, ecsClient, opts.Cluster, opts.Task, opts.Container)
+	if err != nil {
+		return err
+	}
+
+	err = startSession(ctx, ssmClient, &ssm.StartSessionInput{
+		Target:       aws.String(target),
+		DocumentName: aws.String("AWS-StartPortForwardingSessionToRemoteHost"),
+		Parameters: map[string][]string{
+			"host":            {host},
+			"portNumber":      {port},
+			"localPortNumber": {localPort},
+		},
+	}, opts.Plugin, opts.Region, opts.Profile)
+	if err != nil && ctx.Err() != nil {
+		// Closed with Ctrl-C
+		return nil
+	}
+
+	return err
+}
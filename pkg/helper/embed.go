@@ -0,0 +1,10 @@
+//go:build helper
+
+package helper
+
+import "embed"
+
+// The helpers are generated by "go generate ./...", so they are embedded only with the helper tag.
+//
+//go:embed bin/cp_amd64 bin/cp_arm64
+var bin embed.FS
@@ -0,0 +1,22 @@
+// Package helper embeds the cp helper (cmd/cp) which runs in the container.
+package helper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+//go:generate sh -c "CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -trimpath -ldflags='-s -w' -o bin/cp_amd64 ../../cmd/cp"
+//go:generate sh -c "CGO_ENABLED=0 GOOS=linux GOARCH=arm64 go build -trimpath -ldflags='-s -w' -o bin/cp_arm64 ../../cmd/cp"
+
+// Binary returns the cp helper for the architecture ("amd64" or "arm64") and its SHA-256 checksum.
+func Binary(arch string) ([]byte, string, error) {
+	b, err := bin.ReadFile("bin/cp_" + arch)
+	if err != nil {
+		return nil, "", fmt.Errorf(`The cp helper for %s is not embedded. Build ecsk with "-tags helper" after "go generate ./...".`, arch)
+	}
+
+	sum := sha256.Sum256(b)
+	return b, hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,8 @@
+//go:build !helper
+
+package helper
+
+import "embed"
+
+// Without the helper tag, nothing is embedded, so that ecsk can be built from a fresh clone, and cp with the helper fails at runtime.
+var bin embed.FS
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package session
+
+import (
+	"errors"
+	"os"
+)
+
+// pollableFile is not supported, so reading the console can't be interrupted.
+func pollableFile(f *os.File) (*os.File, error) {
+	return nil, errors.New("The file can't be polled.")
+}
+
+func closePollableFile(p *os.File) {
+	p.Close()
+}
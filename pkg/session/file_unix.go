@@ -0,0 +1,54 @@
+//go:build unix
+
+package session
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// pollableFile duplicates the file in non-blocking mode, so that reading the terminal can be interrupted by the deadline.
+func pollableFile(f *os.File) (*os.File, error) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	fd := -1
+	var dupErr error
+	err = conn.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	p := os.NewFile(uintptr(fd), f.Name())
+	// Some files such as regular files can't be polled
+	if p.SetReadDeadline(time.Time{}) != nil {
+		closePollableFile(p)
+		return nil, errors.New("The file can't be polled.")
+	}
+
+	return p, nil
+}
+
+// closePollableFile restores the blocking mode, which is shared with the original file, and closes the duplicate.
+func closePollableFile(p *os.File) {
+	conn, err := p.SyscallConn()
+	if err == nil {
+		_ = conn.Control(func(fd uintptr) {
+			_ = syscall.SetNonblock(int(fd), false)
+		})
+	}
+	p.Close()
+}
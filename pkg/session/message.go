@@ -0,0 +1,153 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	InputStreamMessage  = "input_stream_data"
+	OutputStreamMessage = "output_stream_data"
+	AcknowledgeMessage  = "acknowledge"
+	ChannelClosed       = "channel_closed"
+	StartPublication    = "start_publication"
+	PausePublication    = "pause_publication"
+)
+
+const (
+	Output            uint32 = 1
+	Error             uint32 = 2
+	Size              uint32 = 3
+	Parameter         uint32 = 4
+	HandshakeRequest  uint32 = 5
+	HandshakeResponse uint32 = 6
+	HandshakeComplete uint32 = 7
+	Flag              uint32 = 10
+	StdErr            uint32 = 11
+	ExitCode          uint32 = 12
+)
+
+// The binary layout of a message is the same as session-manager-plugin.
+// All numbers are big endian, and the payload follows the header.
+const (
+	headerLengthOffset   = 0
+	messageTypeOffset    = 4
+	messageTypeLength    = 32
+	schemaVersionOffset  = 36
+	createdDateOffset    = 40
+	sequenceNumberOffset = 48
+	flagsOffset          = 56
+	messageIdOffset      = 64
+	payloadDigestOffset  = 80
+	payloadTypeOffset    = 112
+	payloadLengthOffset  = 116
+	payloadOffset        = 120
+)
+
+type UUID [16]byte
+
+type Message struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    uint64
+	SequenceNumber int64
+	Flags          uint64
+	MessageId      UUID
+	PayloadType    uint32
+	Payload        []byte
+}
+
+func NewUUID() UUID {
+	var u UUID
+	_, _ = rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return u
+}
+
+func (u UUID) String() string {
+	b := make([]byte, 36)
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b)
+}
+
+func newMessage(messageType string, sequenceNumber int64, flags uint64, payloadType uint32, payload []byte) *Message {
+	return &Message{
+		MessageType:    messageType,
+		SchemaVersion:  1,
+		CreatedDate:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		SequenceNumber: sequenceNumber,
+		Flags:          flags,
+		MessageId:      NewUUID(),
+		PayloadType:    payloadType,
+		Payload:        payload,
+	}
+}
+
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if len(m.MessageType) > messageTypeLength {
+		return nil, errors.New("Message type is too long.")
+	}
+
+	b := make([]byte, payloadOffset+len(m.Payload))
+	binary.BigEndian.PutUint32(b[headerLengthOffset:], payloadLengthOffset)
+	copy(b[messageTypeOffset:schemaVersionOffset], bytes.Repeat([]byte{' '}, messageTypeLength))
+	copy(b[messageTypeOffset:schemaVersionOffset], m.MessageType)
+	binary.BigEndian.PutUint32(b[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(b[createdDateOffset:], m.CreatedDate)
+	binary.BigEndian.PutUint64(b[sequenceNumberOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(b[flagsOffset:], m.Flags)
+	// The least significant half of the message ID comes first.
+	copy(b[messageIdOffset:], m.MessageId[8:])
+	copy(b[messageIdOffset+8:], m.MessageId[:8])
+	digest := sha256.Sum256(m.Payload)
+	copy(b[payloadDigestOffset:], digest[:])
+	binary.BigEndian.PutUint32(b[payloadTypeOffset:], m.PayloadType)
+	binary.BigEndian.PutUint32(b[payloadLengthOffset:], uint32(len(m.Payload)))
+	copy(b[payloadOffset:], m.Payload)
+
+	return b, nil
+}
+
+func (m *Message) UnmarshalBinary(b []byte) error {
+	if len(b) < payloadOffset {
+		return errors.New("Message is too short.")
+	}
+
+	headerLength := binary.BigEndian.Uint32(b[headerLengthOffset:])
+	if int(headerLength)+4 > len(b) || headerLength < payloadLengthOffset {
+		return errors.New("Invalid message header length.")
+	}
+
+	m.MessageType = strings.TrimSpace(strings.TrimRight(string(b[messageTypeOffset:schemaVersionOffset]), "\x00"))
+	m.SchemaVersion = binary.BigEndian.Uint32(b[schemaVersionOffset:])
+	m.CreatedDate = binary.BigEndian.Uint64(b[createdDateOffset:])
+	m.SequenceNumber = int64(binary.BigEndian.Uint64(b[sequenceNumberOffset:]))
+	m.Flags = binary.BigEndian.Uint64(b[flagsOffset:])
+	copy(m.MessageId[8:], b[messageIdOffset:messageIdOffset+8])
+	copy(m.MessageId[:8], b[messageIdOffset+8:payloadDigestOffset])
+	m.PayloadType = binary.BigEndian.Uint32(b[payloadTypeOffset:])
+
+	payloadLength := binary.BigEndian.Uint32(b[headerLength:])
+	start := int(headerLength) + 4
+	if start+int(payloadLength) > len(b) {
+		return errors.New("Invalid message payload length.")
+	}
+	m.Payload = b[start : start+int(payloadLength)]
+
+	return nil
+}
@@ -0,0 +1,531 @@
+// Package session is a Session Manager client that speaks the data channel protocol of the SSM agent,
+// so that ECS Exec can be used without session-manager-plugin.
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const ClientVersion = "1.2.0.0"
+
+const (
+	actionSuccess = 1
+	actionFailed  = 2
+)
+
+// The input messages which are not acknowledged in resendTimeout are sent again, like session-manager-plugin.
+var (
+	resendTimeout     = time.Second
+	resendInterval    = 100 * time.Millisecond
+	maxResendAttempts = 60
+)
+
+// UnsupportedError is returned if the agent requests the actions which are not supported, such as KMSEncryption.
+// session-manager-plugin should be used instead.
+type UnsupportedError struct {
+	Actions []string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s is not supported by the built-in Session Manager client.", strings.Join(e.Actions, ", "))
+}
+
+type Session struct {
+	conn *websocket.Conn
+
+	writeMu        sync.Mutex
+	sequenceNumber int64
+	unacknowledged map[int64]*outgoingMessage
+	resendTimeout  time.Duration
+	resendInterval time.Duration
+
+	expectedSequenceNumber int64
+	incoming               map[int64]*Message
+
+	sizeMu sync.Mutex
+	ready  bool
+	cols   int
+	rows   int
+
+	// resume is closed when the agent starts the publication again, and it's nil unless paused.
+	pauseMu sync.Mutex
+	resume  chan struct{}
+}
+
+type outgoingMessage struct {
+	data     []byte
+	sentAt   time.Time
+	attempts int
+}
+
+type openDataChannelInput struct {
+	MessageSchemaVersion string
+	RequestId            string
+	TokenValue           string
+	ClientId             string
+	ClientVersion        string
+}
+
+type acknowledgeContent struct {
+	AcknowledgedMessageType           string
+	AcknowledgedMessageId             string
+	AcknowledgedMessageSequenceNumber int64
+	IsSequentialMessage               bool
+}
+
+type handshakeRequestPayload struct {
+	AgentVersion           string
+	RequestedClientActions []struct {
+		ActionType       string
+		ActionParameters json.RawMessage
+	}
+}
+
+type handshakeResponsePayload struct {
+	ClientVersion          string
+	ProcessedClientActions []processedClientAction
+	Errors                 []string
+}
+
+type processedClientAction struct {
+	ActionType   string
+	ActionStatus int
+	ActionResult json.RawMessage
+	Error        string
+}
+
+type channelClosedPayload struct {
+	SessionId string
+	Output    string
+}
+
+type sizePayload struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+// Open connects to the stream URL of a session returned by ExecuteCommand or StartSession.
+func Open(ctx context.Context, streamUrl string, token string) (*Session, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, streamUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.WriteJSON(openDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestId:            NewUUID().String(),
+		TokenValue:           token,
+		ClientId:             NewUUID().String(),
+		ClientVersion:        ClientVersion,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Session{
+		conn:           conn,
+		unacknowledged: make(map[int64]*outgoingMessage),
+		resendTimeout:  resendTimeout,
+		resendInterval: resendInterval,
+		incoming:       make(map[int64]*Message),
+	}, nil
+}
+
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// Run transfers stdin to the session and the output of the session to stdout and stderr until the session is closed.
+// The exit code is returned if the agent reports it.
+func (s *Session) Run(ctx context.Context, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Minute):
+				_ = s.conn.WriteControl(websocket.PingMessage, []byte("keepalive"), time.Now().Add(10*time.Second))
+			}
+		}
+	}()
+
+	resendErrs := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(s.resendInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := s.resend()
+			if err != nil {
+				resendErrs <- err
+				s.conn.Close()
+				return
+			}
+		}
+	}()
+
+	ready := make(chan struct{})
+	markReady := sync.OnceFunc(func() {
+		close(ready)
+
+		s.sizeMu.Lock()
+		s.ready = true
+		cols, rows := s.cols, s.rows
+		s.sizeMu.Unlock()
+
+		if cols > 0 && rows > 0 {
+			_ = s.sendSize(cols, rows)
+		}
+	})
+
+	stopInput := s.startInput(ready, stdin)
+	defer stopInput()
+
+	exitCode := 0
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			select {
+			case err := <-resendErrs:
+				return exitCode, err
+			default:
+			}
+			if ctx.Err() != nil {
+				return exitCode, nil
+			}
+			return exitCode, err
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		m := &Message{}
+		err = m.UnmarshalBinary(data)
+		if err != nil {
+			return exitCode, err
+		}
+
+		switch m.MessageType {
+		case AcknowledgeMessage:
+			var content acknowledgeContent
+			err := json.Unmarshal(m.Payload, &content)
+			if err != nil {
+				return exitCode, err
+			}
+
+			s.writeMu.Lock()
+			delete(s.unacknowledged, content.AcknowledgedMessageSequenceNumber)
+			s.writeMu.Unlock()
+		case OutputStreamMessage:
+			err := s.acknowledge(m)
+			if err != nil {
+				return exitCode, err
+			}
+			if m.SequenceNumber < s.expectedSequenceNumber {
+				continue
+			}
+
+			// Messages may arrive out of order, so buffer them until the expected one arrives.
+			s.incoming[m.SequenceNumber] = m
+			for {
+				next, ok := s.incoming[s.expectedSequenceNumber]
+				if !ok {
+					break
+				}
+				delete(s.incoming, s.expectedSequenceNumber)
+				s.expectedSequenceNumber++
+
+				switch next.PayloadType {
+				case Output:
+					markReady()
+					_, err = stdout.Write(next.Payload)
+				case StdErr:
+					_, err = stderr.Write(next.Payload)
+				case ExitCode:
+					exitCode, err = strconv.Atoi(strings.TrimSpace(string(next.Payload)))
+				case HandshakeRequest:
+					err = s.handshake(next.Payload)
+					// The command may have started, so it must not be executed again with session-manager-plugin
+					var unsupportedErr *UnsupportedError
+					if errors.As(err, &unsupportedErr) && isClosed(ready) {
+						err = errors.New(err.Error())
+					}
+				case HandshakeComplete:
+					markReady()
+				}
+				if err != nil {
+					return exitCode, err
+				}
+			}
+		case PausePublication:
+			s.pauseMu.Lock()
+			if s.resume == nil {
+				s.resume = make(chan struct{})
+			}
+			s.pauseMu.Unlock()
+		case StartPublication:
+			s.pauseMu.Lock()
+			if s.resume != nil {
+				close(s.resume)
+				s.resume = nil
+			}
+			s.pauseMu.Unlock()
+		case ChannelClosed:
+			var payload channelClosedPayload
+			_ = json.Unmarshal(m.Payload, &payload)
+			if payload.Output != "" {
+				_, _ = io.WriteString(stderr, payload.Output+"\n")
+			}
+			return exitCode, nil
+		}
+	}
+}
+
+// startInput sends stdin to the session after it's ready, and returns the function to stop it.
+// Stopping waits for the reader if the read can be interrupted, so that the input after the session isn't consumed.
+func (s *Session) startInput(ready <-chan struct{}, stdin io.Reader) func() {
+	r, interrupt, restore := interruptibleReader(stdin)
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-stopped:
+			return
+		case <-ready:
+		}
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if !s.waitPublication(stopped) {
+					return
+				}
+				if err := s.send(Output, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		if interrupt == nil {
+			// The reader ends with the next input, which is not sent
+			return
+		}
+		interrupt()
+		<-done
+		restore()
+	}
+}
+
+// waitPublication waits while the agent pauses the publication, and returns false if stopped.
+func (s *Session) waitPublication(stopped <-chan struct{}) bool {
+	for {
+		s.pauseMu.Lock()
+		resume := s.resume
+		s.pauseMu.Unlock()
+
+		if resume == nil {
+			return !isClosed(stopped)
+		}
+		select {
+		case <-stopped:
+			return false
+		case <-resume:
+		}
+	}
+}
+
+// interruptibleReader returns the reader whose blocking read can be interrupted, and the functions to interrupt it and to restore the file.
+// The interrupt function is nil if the reader can't be interrupted.
+func interruptibleReader(r io.Reader) (io.Reader, func(), func()) {
+	f, ok := r.(*os.File)
+	if !ok {
+		return r, nil, nil
+	}
+
+	// Pipes are pollable, so the read is interrupted by the deadline
+	if f.SetReadDeadline(time.Time{}) == nil {
+		return f, func() { _ = f.SetReadDeadline(time.Now()) }, func() { _ = f.SetReadDeadline(time.Time{}) }
+	}
+
+	p, err := pollableFile(f)
+	if err != nil {
+		return r, nil, nil
+	}
+	return p, func() { _ = p.SetReadDeadline(time.Now()) }, func() { closePollableFile(p) }
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetSize changes the terminal size of the session.
+func (s *Session) SetSize(cols int, rows int) error {
+	s.sizeMu.Lock()
+	if s.cols == cols && s.rows == rows {
+		s.sizeMu.Unlock()
+		return nil
+	}
+	s.cols = cols
+	s.rows = rows
+	ready := s.ready
+	s.sizeMu.Unlock()
+
+	if !ready {
+		return nil
+	}
+	return s.sendSize(cols, rows)
+}
+
+func (s *Session) sendSize(cols int, rows int) error {
+	payload, err := json.Marshal(sizePayload{Cols: cols, Rows: rows})
+	if err != nil {
+		return err
+	}
+	return s.send(Size, payload)
+}
+
+func (s *Session) handshake(payload []byte) error {
+	var request handshakeRequestPayload
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return err
+	}
+
+	response := handshakeResponsePayload{ClientVersion: ClientVersion}
+	var unsupported []string
+	for _, a := range request.RequestedClientActions {
+		switch a.ActionType {
+		case "SessionType":
+			response.ProcessedClientActions = append(response.ProcessedClientActions, processedClientAction{
+				ActionType:   a.ActionType,
+				ActionStatus: actionSuccess,
+			})
+		default:
+			message := a.ActionType + " is not supported by the built-in Session Manager client."
+			response.ProcessedClientActions = append(response.ProcessedClientActions, processedClientAction{
+				ActionType:   a.ActionType,
+				ActionStatus: actionFailed,
+				Error:        message,
+			})
+			response.Errors = append(response.Errors, message)
+			unsupported = append(unsupported, a.ActionType)
+		}
+	}
+
+	b, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	err = s.send(HandshakeResponse, b)
+	if err != nil {
+		return err
+	}
+	if len(unsupported) > 0 {
+		return &UnsupportedError{Actions: unsupported}
+	}
+
+	return nil
+}
+
+func (s *Session) send(payloadType uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	b, err := newMessage(InputStreamMessage, s.sequenceNumber, 0, payloadType, payload).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	err = s.conn.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return err
+	}
+	s.unacknowledged[s.sequenceNumber] = &outgoingMessage{data: b, sentAt: time.Now(), attempts: 1}
+	s.sequenceNumber++
+
+	return nil
+}
+
+// resend sends the input messages again which are not acknowledged in time.
+func (s *Session) resend() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	for _, m := range s.unacknowledged {
+		if time.Since(m.sentAt) < s.resendTimeout {
+			continue
+		}
+		if m.attempts >= maxResendAttempts {
+			return errors.New("The input is not acknowledged by the agent.")
+		}
+
+		err := s.conn.WriteMessage(websocket.BinaryMessage, m.data)
+		if err != nil {
+			return err
+		}
+		m.sentAt = time.Now()
+		m.attempts++
+	}
+
+	return nil
+}
+
+func (s *Session) acknowledge(m *Message) error {
+	payload, err := json.Marshal(acknowledgeContent{
+		AcknowledgedMessageType:           m.MessageType,
+		AcknowledgedMessageId:             m.MessageId.String(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	b, err := newMessage(AcknowledgeMessage, 0, 3, 0, payload).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, b)
+}
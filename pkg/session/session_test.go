@@ -0,0 +1,428 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// agent replays the data channel protocol of the SSM agent.
+type agent struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	sequence int64
+	messages chan *Message
+	acked    map[int64]bool
+}
+
+func startAgent(t *testing.T, script func(a *agent)) (*Session, func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		var input openDataChannelInput
+		err = conn.ReadJSON(&input)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if input.TokenValue != "token" {
+			t.Errorf("TokenValue = %q, want %q", input.TokenValue, "token")
+		}
+
+		a := &agent{t: t, conn: conn, messages: make(chan *Message, 100), acked: make(map[int64]bool)}
+		go func() {
+			defer close(a.messages)
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				m := &Message{}
+				if err := m.UnmarshalBinary(data); err != nil {
+					t.Error(err)
+					return
+				}
+				// The payload refers to the buffer of the connection
+				m.Payload = append([]byte{}, m.Payload...)
+				a.messages <- m
+			}
+		}()
+		script(a)
+	}))
+
+	s, err := Open(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		s.Close()
+		<-done
+		server.Close()
+	}
+}
+
+func (a *agent) send(payloadType uint32, payload []byte) {
+	a.sendAt(a.sequence, payloadType, payload)
+	a.sequence++
+}
+
+func (a *agent) sendAt(sequence int64, payloadType uint32, payload []byte) {
+	a.t.Helper()
+
+	b, err := newMessage(OutputStreamMessage, sequence, 0, payloadType, payload).MarshalBinary()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+func (a *agent) sendJSON(messageType string, payloadType uint32, v interface{}) {
+	a.t.Helper()
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	b, err := newMessage(messageType, 0, 0, payloadType, payload).MarshalBinary()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if err := a.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+func (a *agent) acknowledge(m *Message) {
+	a.sendJSON(AcknowledgeMessage, 0, acknowledgeContent{
+		AcknowledgedMessageType:           m.MessageType,
+		AcknowledgedMessageId:             m.MessageId.String(),
+		AcknowledgedMessageSequenceNumber: m.SequenceNumber,
+		IsSequentialMessage:               true,
+	})
+}
+
+// readInput returns the next input message, and records the acknowledgements before it.
+func (a *agent) readInput() *Message {
+	a.t.Helper()
+
+	for {
+		select {
+		case m, ok := <-a.messages:
+			if !ok {
+				a.t.Fatal("The connection is closed.")
+			}
+			if m.MessageType == AcknowledgeMessage {
+				var content acknowledgeContent
+				if err := json.Unmarshal(m.Payload, &content); err != nil {
+					a.t.Fatal(err)
+				}
+				a.acked[content.AcknowledgedMessageSequenceNumber] = true
+				continue
+			}
+			if m.MessageType != InputStreamMessage {
+				a.t.Fatalf("MessageType = %q, want %q", m.MessageType, InputStreamMessage)
+			}
+			return m
+		case <-time.After(5 * time.Second):
+			a.t.Fatal("Timed out waiting for the input.")
+		}
+	}
+}
+
+// waitAcknowledged waits for the acknowledgements of the output messages.
+func (a *agent) waitAcknowledged(sequences ...int64) {
+	a.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for _, seq := range sequences {
+		for !a.acked[seq] {
+			select {
+			case m, ok := <-a.messages:
+				if !ok {
+					a.t.Fatal("The connection is closed.")
+				}
+				if m.MessageType != AcknowledgeMessage {
+					a.t.Fatalf("MessageType = %q, want %q", m.MessageType, AcknowledgeMessage)
+				}
+				var content acknowledgeContent
+				if err := json.Unmarshal(m.Payload, &content); err != nil {
+					a.t.Fatal(err)
+				}
+				a.acked[content.AcknowledgedMessageSequenceNumber] = true
+			case <-timeout:
+				a.t.Fatalf("Timed out waiting for the acknowledgement of %d.", seq)
+			}
+		}
+	}
+}
+
+// handshake requests the actions, and returns the response of the client.
+func (a *agent) handshake(actions ...string) handshakeResponsePayload {
+	a.t.Helper()
+
+	var request handshakeRequestPayload
+	request.AgentVersion = "3.2.0.0"
+	for _, action := range actions {
+		request.RequestedClientActions = append(request.RequestedClientActions, struct {
+			ActionType       string
+			ActionParameters json.RawMessage
+		}{ActionType: action, ActionParameters: json.RawMessage(`{}`)})
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	a.send(HandshakeRequest, payload)
+
+	m := a.readInput()
+	if m.PayloadType != HandshakeResponse {
+		a.t.Fatalf("PayloadType = %d, want %d", m.PayloadType, HandshakeResponse)
+	}
+	a.acknowledge(m)
+
+	var response handshakeResponsePayload
+	if err := json.Unmarshal(m.Payload, &response); err != nil {
+		a.t.Fatal(err)
+	}
+	return response
+}
+
+func (a *agent) close() {
+	a.sendJSON(ChannelClosed, 0, channelClosedPayload{SessionId: "session"})
+}
+
+func TestRun(t *testing.T) {
+	s, cleanup := startAgent(t, func(a *agent) {
+		response := a.handshake("SessionType")
+		if len(response.ProcessedClientActions) != 1 || response.ProcessedClientActions[0].ActionStatus != actionSuccess {
+			t.Errorf("ProcessedClientActions = %+v, want SessionType succeeded", response.ProcessedClientActions)
+		}
+		a.send(HandshakeComplete, []byte(`{}`))
+
+		// The input is sent after the handshake is completed
+		m := a.readInput()
+		if m.SequenceNumber != 1 || m.PayloadType != Output || string(m.Payload) != "ls\n" {
+			t.Errorf("input = %d %d %q, want 1 %d %q", m.SequenceNumber, m.PayloadType, m.Payload, Output, "ls\n")
+		}
+		a.acknowledge(m)
+
+		// Out of order and duplicated messages
+		a.sendAt(3, Output, []byte("world\n"))
+		a.sendAt(2, Output, []byte("hello "))
+		a.sendAt(2, Output, []byte("hello "))
+		a.sendAt(4, StdErr, []byte("warning\n"))
+		a.sendAt(5, ExitCode, []byte("3"))
+		a.waitAcknowledged(0, 1, 2, 3, 4, 5)
+		a.close()
+	})
+	defer cleanup()
+
+	var stdout, stderr bytes.Buffer
+	code, err := s.Run(context.Background(), strings.NewReader("ls\n"), &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if stdout.String() != "hello world\n" {
+		t.Errorf("stdout = %q, want %q", stdout.String(), "hello world\n")
+	}
+	if stderr.String() != "warning\n" {
+		t.Errorf("stderr = %q, want %q", stderr.String(), "warning\n")
+	}
+}
+
+func TestRunResendsUnacknowledgedInput(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		resendTimeout, resendInterval = timeout, interval
+	}(resendTimeout, resendInterval)
+	resendTimeout = 50 * time.Millisecond
+	resendInterval = 10 * time.Millisecond
+
+	s, cleanup := startAgent(t, func(a *agent) {
+		a.handshake("SessionType")
+		a.send(HandshakeComplete, []byte(`{}`))
+
+		// The lost input is sent again with the same sequence number
+		first := a.readInput()
+		second := a.readInput()
+		if first.SequenceNumber != second.SequenceNumber || string(first.Payload) != string(second.Payload) {
+			t.Errorf("resent input = %d %q, want %d %q", second.SequenceNumber, second.Payload, first.SequenceNumber, first.Payload)
+		}
+		a.acknowledge(second)
+
+		// No more messages after the acknowledgement
+		select {
+		case m := <-a.messages:
+			if m.MessageType != AcknowledgeMessage {
+				t.Errorf("unexpected message after the acknowledgement: %s %d", m.MessageType, m.SequenceNumber)
+			}
+		case <-time.After(5 * resendTimeout):
+		}
+		a.close()
+	})
+	defer cleanup()
+
+	_, err := s.Run(context.Background(), strings.NewReader("a"), &bytes.Buffer{}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunUnsupportedHandshake(t *testing.T) {
+	s, cleanup := startAgent(t, func(a *agent) {
+		response := a.handshake("SessionType", "KMSEncryption")
+		if len(response.ProcessedClientActions) != 2 || response.ProcessedClientActions[1].ActionStatus != actionFailed {
+			t.Errorf("ProcessedClientActions = %+v, want KMSEncryption failed", response.ProcessedClientActions)
+		}
+	})
+	defer cleanup()
+
+	_, err := s.Run(context.Background(), strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	var unsupportedErr *UnsupportedError
+	if !errors.As(err, &unsupportedErr) {
+		t.Fatalf("err = %v, want UnsupportedError", err)
+	}
+	if len(unsupportedErr.Actions) != 1 || unsupportedErr.Actions[0] != "KMSEncryption" {
+		t.Errorf("Actions = %v, want [KMSEncryption]", unsupportedErr.Actions)
+	}
+}
+
+func TestRunUnsupportedHandshakeAfterStart(t *testing.T) {
+	s, cleanup := startAgent(t, func(a *agent) {
+		a.handshake("SessionType")
+		a.send(HandshakeComplete, []byte(`{}`))
+		a.send(Output, []byte("$ "))
+		a.handshake("KMSEncryption")
+	})
+	defer cleanup()
+
+	_, err := s.Run(context.Background(), strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("Run() succeeded")
+	}
+	// The command may have started, so it must not fall back to the plugin
+	var unsupportedErr *UnsupportedError
+	if errors.As(err, &unsupportedErr) {
+		t.Errorf("err = %v, want not UnsupportedError", err)
+	}
+}
+
+func TestRunPausePublication(t *testing.T) {
+	s, cleanup := startAgent(t, func(a *agent) {
+		a.handshake("SessionType")
+		a.sendJSON(PausePublication, 0, struct{}{})
+		a.send(HandshakeComplete, []byte(`{}`))
+
+		// No input while paused
+		timeout := time.After(200 * time.Millisecond)
+	wait:
+		for {
+			select {
+			case m := <-a.messages:
+				if m.MessageType == InputStreamMessage {
+					t.Errorf("input %q is sent while paused", m.Payload)
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+
+		a.sendJSON(StartPublication, 0, struct{}{})
+		m := a.readInput()
+		if string(m.Payload) != "a" {
+			t.Errorf("input = %q, want %q", m.Payload, "a")
+		}
+		a.acknowledge(m)
+		a.close()
+	})
+	defer cleanup()
+
+	_, err := s.Run(context.Background(), strings.NewReader("a"), &bytes.Buffer{}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunStopsReadingStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	s, cleanup := startAgent(t, func(a *agent) {
+		a.handshake("SessionType")
+		a.send(HandshakeComplete, []byte(`{}`))
+		m := a.readInput()
+		a.acknowledge(m)
+		a.close()
+	})
+	defer cleanup()
+
+	if _, err := w.Write([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Run(context.Background(), r, &bytes.Buffer{}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The input after the session goes to the next reader
+	if _, err := w.Write([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "b" {
+		t.Errorf("Read() = %q, %v, want %q", buf[:n], err, "b")
+	}
+}
+
+func TestMessageBinary(t *testing.T) {
+	m := newMessage(InputStreamMessage, 42, 3, Size, []byte(`{"cols":80,"rows":24}`))
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := &Message{}
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.MessageType != m.MessageType || got.SequenceNumber != m.SequenceNumber || got.Flags != m.Flags ||
+		got.MessageId != m.MessageId || got.PayloadType != m.PayloadType || string(got.Payload) != string(m.Payload) {
+		t.Errorf("UnmarshalBinary() = %+v, want %+v", got, m)
+	}
+
+	if err := got.UnmarshalBinary(b[:payloadOffset-1]); err == nil {
+		t.Error("UnmarshalBinary() of a short message succeeded")
+	}
+}
@@ -0,0 +1,354 @@
+package store
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Pack writes src to w as a tar archive.
+// As with Upload, the entries are relative to src, or the base name if src is a file.
+// If checksum is true, the SHA-256 checksums of the files are recorded to be verified by Unpack.
+// Other tar commands may warn about the records, so disable it if the archive is not extracted by Unpack.
+func Pack(w io.Writer, src string, filter *Filter, checksum bool) error {
+	src, filter, err := filter.Glob(src)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			if info.IsDir() {
+				return nil
+			}
+			rel = filepath.Base(path)
+		}
+
+		if info.IsDir() && filter.Skip(filepath.ToSlash(rel)) {
+			return filepath.SkipDir
+		}
+		// The parent directories of the matched files are created on unpacking even if they don't match.
+		if !filter.Match(filepath.ToSlash(rel), info.IsDir()) {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if !info.Mode().IsRegular() {
+			return tw.WriteHeader(header)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if checksum {
+			sum, err := fileChecksum(file)
+			if err != nil {
+				return err
+			}
+			header.PAXRecords = map[string]string{paxChecksumKey: sum}
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Unpack extracts the tar archive read from r into dst.
+// If owner is true, the owners of the entries are also restored like "docker cp -a".
+func Unpack(r io.Reader, dst string, owner bool, filter *Filter) error {
+	return unpack(r, dst, owner, filter, &progress{})
+}
+
+func unpack(r io.Reader, dst string, owner bool, filter *Filter, p *progress) error {
+	dr, err := decompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(dr)
+	// The modes and times of directories are restored at the end, because extracting the entries changes them.
+	var dirs []*tar.Header
+	// The symlinks are created at the end, so that no entry is written through them.
+	var links []*tar.Header
+	var mismatches []error
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if filepath.Clean(header.Name) == "." || !filter.Match(header.Name, header.Typeflag == tar.TypeDir) {
+			continue
+		}
+
+		path := filepath.Join(dst, filepath.FromSlash(header.Name))
+		// Safety
+		if !within(dst, path) {
+			return fmt.Errorf("Invalid path in archive: %s", header.Name)
+		}
+		err = checkParent(root, path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				return err
+			}
+			// An existing symlink is replaced instead of being written through
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				_ = os.Remove(path)
+			}
+			sum := header.PAXRecords[paxChecksumKey]
+			if sum == "" {
+				err = writeFile(path, tr, mode)
+				break
+			}
+
+			h := sha256.New()
+			err = writeFile(path, io.TeeReader(tr, h), mode)
+			if err == nil {
+				if err := verifyChecksum(sum, hex.EncodeToString(h.Sum(nil))); err != nil {
+					os.Remove(path)
+					mismatches = append(mismatches, fmt.Errorf("%s: %w", header.Name, err))
+					continue
+				}
+			}
+		case tar.TypeSymlink:
+			links = append(links, header)
+			continue
+		default:
+			p.Println("Skipped", header.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if owner {
+			chown(path, header)
+		}
+		if header.Typeflag == tar.TypeReg {
+			_ = os.Chtimes(path, header.ModTime, header.ModTime)
+		}
+
+		p.Println("Extracted", strings.TrimPrefix(header.Name, "./"))
+	}
+
+	for _, header := range links {
+		path := filepath.Join(dst, filepath.FromSlash(header.Name))
+		err := checkParent(root, path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(path)
+		err = os.Symlink(header.Linkname, path)
+		if err != nil {
+			return err
+		}
+
+		if owner {
+			chown(path, header)
+		}
+		p.Println("Extracted", strings.TrimPrefix(header.Name, "./"))
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(dst, filepath.FromSlash(dirs[i].Name))
+		// Skip the directory replaced by a symlink not to change the target
+		if info, err := os.Lstat(path); err != nil || !info.IsDir() {
+			continue
+		}
+		err := os.Chmod(path, os.FileMode(dirs[i].Mode).Perm())
+		if err != nil {
+			return err
+		}
+		_ = os.Chtimes(path, dirs[i].ModTime, dirs[i].ModTime)
+	}
+
+	return errors.Join(mismatches...)
+}
+
+// within reports whether path is root or under root lexically.
+func within(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkParent returns an error if the parent directory of path resolves outside root through symlinks.
+// The directories that don't exist yet are checked by their nearest existing ancestor.
+func checkParent(root string, path string) error {
+	dir := filepath.Dir(path)
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if !within(root, resolved) {
+				return errors.New("The parent directory is a symlink to the outside of the destination.")
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func chown(path string, header *tar.Header) {
+	err := os.Lchown(path, header.Uid, header.Gid)
+	if err != nil {
+		// Same as tar, the owner can't be changed without privileges, so just warn.
+		fmt.Fprintln(os.Stderr, "Failed to change the owner of", header.Name+":", err)
+	}
+}
+
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(path, mode)
+}
+
+// UploadArchive uploads src to the key as a single tar archive compressed with the format.
+func UploadArchive(ctx context.Context, s3Client *s3.Client, bucket string, key string, src string, filter *Filter, compress string) error {
+	// The size is unknown until the archive is packed, so only the transferred bytes are shown.
+	p := newProgress("Uploading", 0)
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(packCompressed(&progressWriter{w: w, p: p}, src, filter, compress))
+	}()
+
+	_, err := manager.NewUploader(s3Client).Upload(ctx, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   r,
+	})
+	r.Close()
+	p.Finish()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Uploaded", filepath.Base(src))
+
+	return nil
+}
+
+func packCompressed(w io.Writer, src string, filter *Filter, compress string) error {
+	cw, err := compressWriter(w, compress)
+	if err != nil {
+		return err
+	}
+
+	err = Pack(cw, src, filter, true)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+
+	return cw.Close()
+}
+
+// DownloadArchive downloads the tar archive of the key, and extracts it into dst.
+// The compression format is detected automatically.
+func DownloadArchive(ctx context.Context, s3Client *s3.Client, bucket string, key string, dst string, owner bool, filter *Filter) error {
+	result, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	p := newProgress("Downloading", result.ContentLength)
+	err = unpack(io.TeeReader(result.Body, &progressWriter{w: io.Discard, p: p}), dst, owner, filter, p)
+	p.Finish()
+	return err
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestUnpack(t *testing.T) {
+	dst := t.TempDir()
+	archive := buildTar(t, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a.txt", typeflag: tar.TypeReg, body: "a"},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "dir/a.txt"},
+	})
+
+	err := Unpack(archive, dst, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dst, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a" {
+		t.Errorf("link = %q, want %q", b, "a")
+	}
+}
+
+func TestUnpackThroughSymlink(t *testing.T) {
+	outside := t.TempDir()
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		setup   func(dst string)
+		wantErr bool
+	}{
+		{
+			name: "symlink in the archive",
+			entries: []tarEntry{
+				{name: "x", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "x/passwd", typeflag: tar.TypeReg, body: "pwned"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "existing symlink directory",
+			entries: []tarEntry{
+				{name: "x/passwd", typeflag: tar.TypeReg, body: "pwned"},
+			},
+			setup: func(dst string) {
+				if err := os.Symlink(outside, filepath.Join(dst, "x")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "existing symlink file",
+			entries: []tarEntry{
+				{name: "passwd", typeflag: tar.TypeReg, body: "pwned"},
+			},
+			setup: func(dst string) {
+				if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(dst, "passwd")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "directory replaced by a symlink",
+			entries: []tarEntry{
+				{name: "x/", typeflag: tar.TypeDir},
+				{name: "x", typeflag: tar.TypeSymlink, linkname: outside},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := t.TempDir()
+			if tt.setup != nil {
+				tt.setup(dst)
+			}
+			info, err := os.Stat(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = Unpack(buildTar(t, tt.entries), dst, false, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Unpack() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(outside, "passwd")); !os.IsNotExist(err) {
+				t.Errorf("a file is written outside the destination")
+			}
+			if after, err := os.Stat(outside); err != nil || after.Mode() != info.Mode() {
+				t.Errorf("the mode outside the destination is changed")
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// TransferPrefix is the prefix of the keys of the objects used for file transfer.
+const TransferPrefix = "ecsk_"
+
+const lifecycleRuleID = "ecsk-transfer"
+
+// SetupBucket creates the bucket if it doesn't exist, and hardens it for file transfer.
+// Public access is blocked, default encryption is enabled, and the objects of transfers expire after a day.
+func SetupBucket(ctx context.Context, s3Client *s3.Client, bucket string, region string) error {
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: &bucket,
+	})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if err != nil {
+		input := &s3.CreateBucketInput{
+			Bucket: &bucket,
+		}
+		// us-east-1 is the default, and it can't be specified.
+		if region != "us-east-1" {
+			input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+				LocationConstraint: types.BucketLocationConstraint(region),
+			}
+		}
+		_, err = s3Client.CreateBucket(ctx, input)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Created", bucket)
+	}
+
+	_, err = s3Client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: &bucket,
+		PublicAccessBlockConfiguration: &types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       true,
+			BlockPublicPolicy:     true,
+			IgnorePublicAcls:      true,
+			RestrictPublicBuckets: true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Blocked public access")
+
+	// The existing encryption (e.g. SSE-KMS) is kept.
+	_, err = s3Client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{
+		Bucket: &bucket,
+	})
+	if isAPIError(err, "ServerSideEncryptionConfigurationNotFoundError") {
+		_, err = s3Client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: &bucket,
+			ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{
+				Rules: []types.ServerSideEncryptionRule{
+					{
+						ApplyServerSideEncryptionByDefault: &types.ServerSideEncryptionByDefault{
+							SSEAlgorithm: types.ServerSideEncryptionAes256,
+						},
+					},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Enabled default encryption")
+	} else if err != nil {
+		return err
+	}
+
+	// The lifecycle configuration is replaced as a whole, so the other rules are kept.
+	var rules []types.LifecycleRule
+	lifecycle, err := s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: &bucket,
+	})
+	if err != nil && !isAPIError(err, "NoSuchLifecycleConfiguration") {
+		return err
+	}
+	if err == nil {
+		for _, r := range lifecycle.Rules {
+			if r.ID != nil && *r.ID == lifecycleRuleID {
+				continue
+			}
+			rules = append(rules, r)
+		}
+	}
+
+	id := lifecycleRuleID
+	rules = append(rules, types.LifecycleRule{
+		ID:     &id,
+		Status: types.ExpirationStatusEnabled,
+		Filter: &types.LifecycleRuleFilterMemberPrefix{Value: TransferPrefix},
+		Expiration: &types.LifecycleExpiration{
+			Days: 1,
+		},
+		AbortIncompleteMultipartUpload: &types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: 1,
+		},
+	})
+	_, err = s3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: &bucket,
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added the lifecycle rule to expire %s* after a day\n", TransferPrefix)
+
+	return nil
+}
+
+// Transfer is the objects and the incomplete multipart uploads left by a transfer.
+type Transfer struct {
+	Name         string
+	Keys         []string
+	Size         int64
+	LastModified time.Time
+	uploads      []types.MultipartUpload
+}
+
+// ListTransfers groups the objects and the incomplete multipart uploads in the bucket by transfer, in order of last modified.
+func ListTransfers(ctx context.Context, s3Client *s3.Client, bucket string) ([]*Transfer, error) {
+	transfers := make(map[string]*Transfer)
+	get := func(key string, modified time.Time) *Transfer {
+		// "ecsk_<timestamp>/...", "ecsk_<timestamp>.tar.gz" and "ecsk_<timestamp>.deleted" belong to the same transfer.
+		name, _, _ := strings.Cut(key, "/")
+		name, _, _ = strings.Cut(name, ".")
+		t, ok := transfers[name]
+		if !ok {
+			t = &Transfer{Name: name}
+			transfers[name] = t
+		}
+		if modified.After(t.LastModified) {
+			t.LastModified = modified
+		}
+		return t
+	}
+
+	prefix := TransferPrefix
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			t := get(*c.Key, *c.LastModified)
+			t.Keys = append(t.Keys, *c.Key)
+			t.Size += c.Size
+		}
+	}
+
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}
+	for {
+		result, err := s3Client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range result.Uploads {
+			t := get(*u.Key, *u.Initiated)
+			t.uploads = append(t.uploads, u)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		input.KeyMarker = result.NextKeyMarker
+		input.UploadIdMarker = result.NextUploadIdMarker
+	}
+
+	var list []*Transfer
+	for _, t := range transfers {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].LastModified.Equal(list[j].LastModified) {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].LastModified.Before(list[j].LastModified)
+	})
+
+	return list, nil
+}
+
+// Uploads returns the number of the incomplete multipart uploads.
+func (t *Transfer) Uploads() int {
+	return len(t.uploads)
+}
+
+// DeleteTransfer deletes the objects and aborts the incomplete multipart uploads of the transfer.
+func DeleteTransfer(ctx context.Context, s3Client *s3.Client, bucket string, t *Transfer) error {
+	err := DeleteKeys(ctx, s3Client, bucket, t.Keys)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range t.uploads {
+		_, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   &bucket,
+			Key:      u.Key,
+			UploadId: u.UploadId,
+		})
+		if err != nil && !isAPIError(err, "NoSuchUpload") {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isAPIError(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
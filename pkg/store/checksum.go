@@ -0,0 +1,49 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// checksumKey is the key of the object metadata, and of the PAX record in tar archives with the "ECSK." vendor prefix.
+const checksumKey = "sha256"
+
+const paxChecksumKey = "ECSK." + checksumKey
+
+func fileChecksum(file *os.File) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func pathChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return fileChecksum(file)
+}
+
+func verifyFile(path string, expected string) error {
+	sum, err := pathChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	return verifyChecksum(expected, sum)
+}
+
+func verifyChecksum(expected string, actual string) error {
+	if expected != actual {
+		return fmt.Errorf("SHA-256 mismatch: expected %s, but got %s", expected, actual)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats of tar archives.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func ValidateCompress(compress string) error {
+	switch compress {
+	case "", Gzip, Zstd:
+		return nil
+	}
+	return fmt.Errorf(`Unknown compression format: %s. The accepted values are "%s" and "%s".`, compress, Gzip, Zstd)
+}
+
+// ArchiveKey returns the key of the tar archive for the key with the extension of the compression format.
+// The extension is not appended if the key already has it.
+func ArchiveKey(key string, compress string) string {
+	ext := ".tar"
+	switch compress {
+	case Gzip:
+		ext += ".gz"
+	case Zstd:
+		ext += ".zst"
+	}
+
+	key = strings.TrimSuffix(key, "/")
+	if strings.HasSuffix(key, ext) {
+		return key
+	}
+	return strings.TrimSuffix(key, ".tar") + ext
+}
+
+// compressWriter returns the writer which compresses the data to w with the format.
+// It must be closed to flush the data.
+func compressWriter(w io.Writer, compress string) (io.WriteCloser, error) {
+	switch compress {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case "":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, ValidateCompress(compress)
+}
+
+// decompressReader detects the compression format by the magic number, so the receiving side needs no option.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Filter selects the files to transfer with gitignore-style patterns.
+// A nil Filter selects all files.
+type Filter struct {
+	include []pattern
+	exclude []pattern
+	glob    *pattern
+}
+
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+func NewFilter(include []string, exclude []string) (*Filter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	f := &Filter{}
+	for _, s := range include {
+		p, err := compilePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, p)
+	}
+	for _, s := range exclude {
+		p, err := compilePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, p)
+	}
+
+	return f, nil
+}
+
+// Glob splits src at the first component with wildcards, and returns the directory to walk and the filter which also requires the rest of src.
+// If src has no wildcards, it is returned as is.
+func (f *Filter) Glob(src string) (string, *Filter, error) {
+	parts := strings.Split(filepath.ToSlash(src), "/")
+	for i, s := range parts {
+		if !strings.ContainsAny(s, "*?[") {
+			continue
+		}
+
+		root := strings.Join(parts[:i], "/")
+		if root == "" {
+			root = "."
+			if i > 0 {
+				root = "/"
+			}
+		}
+
+		// The rest is anchored to the root
+		p, err := compilePattern("/" + strings.Join(parts[i:], "/"))
+		if err != nil {
+			return "", nil, err
+		}
+
+		clone := &Filter{glob: &p}
+		if f != nil {
+			clone.include = f.include
+			clone.exclude = f.exclude
+		}
+		return filepath.FromSlash(root), clone, nil
+	}
+
+	return src, f, nil
+}
+
+// Match reports whether the entry at the slash-separated path relative to the root is transferred.
+func (f *Filter) Match(rel string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+	rel = strings.TrimPrefix(path.Clean(rel), "./")
+	return !f.excluded(rel, isDir) && f.included(rel, isDir)
+}
+
+// Skip reports whether the directory and all entries in it are excluded.
+func (f *Filter) Skip(rel string) bool {
+	if f == nil {
+		return false
+	}
+	rel = strings.TrimPrefix(path.Clean(rel), "./")
+	return f.excluded(rel, true)
+}
+
+// As with gitignore, an entry is excluded if itself or one of its parent directories matches the patterns.
+func (f *Filter) excluded(rel string, isDir bool) bool {
+	parts := strings.Split(rel, "/")
+	for i := 1; i <= len(parts); i++ {
+		dir := i < len(parts) || isDir
+		if matchPatterns(f.exclude, strings.Join(parts[:i], "/"), dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// An entry is included if itself or one of its parent directories matches both the include patterns and the glob.
+func (f *Filter) included(rel string, isDir bool) bool {
+	included := len(f.include) == 0
+	globbed := f.glob == nil
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i <= len(parts); i++ {
+		dir := i < len(parts) || isDir
+		p := strings.Join(parts[:i], "/")
+		if !included && matchPatterns(f.include, p, dir) {
+			included = true
+		}
+		if !globbed && matchPatterns([]pattern{*f.glob}, p, dir) {
+			globbed = true
+		}
+	}
+	return included && globbed
+}
+
+// The last matching pattern wins, so that "!" can re-include the entries.
+func matchPatterns(patterns []pattern, p string, isDir bool) bool {
+	matched := false
+	for _, pt := range patterns {
+		if pt.dirOnly && !isDir {
+			continue
+		}
+		if pt.re.MatchString(p) {
+			matched = !pt.negate
+		}
+	}
+	return matched
+}
+
+// compilePattern converts a gitignore-style pattern to a regular expression.
+// A pattern without "/" matches at any depth, and "**" matches any number of directories.
+func compilePattern(s string) (pattern, error) {
+	var p pattern
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+	anchored := strings.Contains(s, "/")
+	s = strings.TrimPrefix(s, "/")
+
+	var b strings.Builder
+	r := []rune(s)
+	for i := 0; i < len(r); i++ {
+		rest := string(r[i:])
+		switch {
+		case strings.HasPrefix(rest, "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case rest == "/**":
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(rest, "**"):
+			b.WriteString(".*")
+			i++
+		case r[i] == '*':
+			b.WriteString("[^/]*")
+		case r[i] == '?':
+			b.WriteString("[^/]")
+		case r[i] == '[':
+			j := strings.IndexRune(string(r[i+1:]), ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := []rune(string(r[i+1:])[:j])
+			if len(class) > 0 && class[0] == '!' {
+				class[0] = '^'
+			}
+			b.WriteString("[" + strings.ReplaceAll(string(class), `\`, `\\`) + "]")
+			i += len(class) + 1
+		case r[i] == '\\' && i+1 < len(r):
+			b.WriteString(regexp.QuoteMeta(string(r[i+1])))
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r[i])))
+		}
+	}
+
+	prefix := "^(?:.*/)?"
+	if anchored {
+		prefix = "^"
+	}
+	re, err := regexp.Compile(prefix + b.String() + "$")
+	if err != nil {
+		return pattern{}, err
+	}
+	p.re = re
+
+	return p, nil
+}
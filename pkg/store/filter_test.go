@@ -0,0 +1,177 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{name: "no patterns", rel: "a/b.txt", want: true},
+
+		// Patterns without "/" match at any depth
+		{name: "basename", exclude: []string{"*.log"}, rel: "app.log", want: false},
+		{name: "basename in subdirectory", exclude: []string{"*.log"}, rel: "var/log/app.log", want: false},
+		{name: "basename not matched", exclude: []string{"*.log"}, rel: "app.txt", want: true},
+		{name: "star doesn't cross directories", exclude: []string{"a*c"}, rel: "ab/c", want: true},
+		{name: "question mark", exclude: []string{"?.txt"}, rel: "a.txt", want: false},
+		{name: "question mark doesn't match slash", exclude: []string{"a?b"}, rel: "a/b", want: true},
+
+		// Patterns with "/" are anchored to the root
+		{name: "anchored", exclude: []string{"/build"}, rel: "build/out.o", want: false},
+		{name: "anchored not in subdirectory", exclude: []string{"/build"}, rel: "src/build", want: true},
+		{name: "middle slash anchors", exclude: []string{"src/*.go"}, rel: "src/main.go", want: false},
+		{name: "middle slash not in subdirectory", exclude: []string{"src/*.go"}, rel: "pkg/src/main.go", want: true},
+
+		// Entries in excluded directories are excluded
+		{name: "parent directory", exclude: []string{"node_modules"}, rel: "web/node_modules/a/index.js", want: false},
+
+		// "**"
+		{name: "leading double star", exclude: []string{"**/cache"}, rel: "cache", want: false},
+		{name: "leading double star in subdirectory", exclude: []string{"**/cache"}, rel: "a/b/cache", want: false},
+		{name: "trailing double star", exclude: []string{"logs/**"}, rel: "logs/a/b.log", want: false},
+		{name: "trailing double star not the directory", exclude: []string{"logs/**"}, rel: "logs", isDir: true, want: true},
+		{name: "middle double star", exclude: []string{"a/**/z"}, rel: "a/z", want: false},
+		{name: "middle double star with directories", exclude: []string{"a/**/z"}, rel: "a/b/c/z", want: false},
+		{name: "middle double star other root", exclude: []string{"a/**/z"}, rel: "b/c/z", want: true},
+
+		// Character classes
+		{name: "class", exclude: []string{"file[0-9].txt"}, rel: "file1.txt", want: false},
+		{name: "class not matched", exclude: []string{"file[0-9].txt"}, rel: "filea.txt", want: true},
+		{name: "negated class", exclude: []string{"file[!0-9].txt"}, rel: "filea.txt", want: false},
+		{name: "negated class not matched", exclude: []string{"file[!0-9].txt"}, rel: "file1.txt", want: true},
+		{name: "unterminated class is literal", exclude: []string{"a[b"}, rel: "a[b", want: false},
+		{name: "escaped wildcard", exclude: []string{`\*.txt`}, rel: "*.txt", want: false},
+		{name: "escaped wildcard is literal", exclude: []string{`\*.txt`}, rel: "a.txt", want: true},
+
+		// Directory-only patterns
+		{name: "directory only", exclude: []string{"tmp/"}, rel: "tmp", isDir: true, want: false},
+		{name: "directory only not a file", exclude: []string{"tmp/"}, rel: "tmp", want: true},
+		{name: "directory only parent", exclude: []string{"tmp/"}, rel: "tmp/a.txt", want: false},
+
+		// Negation
+		{name: "negation", exclude: []string{"*.log", "!keep.log"}, rel: "keep.log", want: true},
+		{name: "negation others", exclude: []string{"*.log", "!keep.log"}, rel: "drop.log", want: false},
+		{name: "last pattern wins", exclude: []string{"!keep.log", "*.log"}, rel: "keep.log", want: false},
+		{name: "negation in excluded directory", exclude: []string{"logs/", "!logs/keep.log"}, rel: "logs/keep.log", want: false},
+		{name: "negation of the files in the directory", exclude: []string{"logs/*", "!logs/keep.log"}, rel: "logs/keep.log", want: true},
+
+		// Include patterns
+		{name: "include", include: []string{"*.go"}, rel: "cmd/main.go", want: true},
+		{name: "include not matched", include: []string{"*.go"}, rel: "README.md", want: false},
+		{name: "include directory", include: []string{"/src"}, rel: "src/a/b.txt", want: true},
+		{name: "include and exclude", include: []string{"*.go"}, exclude: []string{"*_test.go"}, rel: "a_test.go", want: false},
+
+		// Paths are cleaned
+		{name: "dot prefix", exclude: []string{"/a.txt"}, rel: "./a.txt", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Match(tt.rel, tt.isDir); got != tt.want {
+				t.Errorf("Match(%q, %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterSkip(t *testing.T) {
+	f, err := NewFilter(nil, []string{".git/", "build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{rel: ".git", want: true},
+		{rel: "a/build", want: true},
+		{rel: "src", want: false},
+	}
+	for _, tt := range tests {
+		if got := f.Skip(tt.rel); got != tt.want {
+			t.Errorf("Skip(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestFilterGlob(t *testing.T) {
+	tests := []struct {
+		src     string
+		exclude []string
+		root    string
+		matches map[string]bool
+	}{
+		{
+			src:     "/var/log/nginx",
+			root:    "/var/log/nginx",
+			matches: map[string]bool{"access.log": true},
+		},
+		{
+			src:     "/var/log/*.log",
+			root:    "/var/log",
+			matches: map[string]bool{"syslog.log": true, "nginx/access.log": false, "syslog": false},
+		},
+		{
+			src:     "/var/log/*/access.log",
+			root:    "/var/log",
+			matches: map[string]bool{"nginx/access.log": true, "nginx/error.log": false},
+		},
+		{
+			src:     "/srv/**/*.conf",
+			exclude: []string{"old/"},
+			root:    "/srv",
+			matches: map[string]bool{"a.conf": true, "a/b/c.conf": true, "old/a.conf": false},
+		},
+		{
+			src:     "*.txt",
+			root:    ".",
+			matches: map[string]bool{"a.txt": true, "a.md": false},
+		},
+		{
+			src:     "/*",
+			root:    "/",
+			matches: map[string]bool{"etc": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			f, err := NewFilter(nil, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			root, f, err := f.Glob(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root != filepath.FromSlash(tt.root) {
+				t.Errorf("Glob(%q) root = %q, want %q", tt.src, root, tt.root)
+			}
+			for rel, want := range tt.matches {
+				if got := f.Match(rel, false); got != want {
+					t.Errorf("Match(%q) = %v, want %v", rel, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewFilterInvalidPattern(t *testing.T) {
+	_, err := NewFilter([]string{"[z-a]"}, nil)
+	if err == nil {
+		t.Error("NewFilter() with an invalid class succeeded")
+	}
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Manifest maps the slash-separated relative paths of the files in a directory to their states.
+type Manifest map[string]ManifestEntry
+
+type ManifestEntry struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Sum     string      `json:"sha256"`
+}
+
+// NewManifest hashes the files in src.
+// The checksums in prev are reused for the files with the same size and modification time, so that only the modified files are read.
+func NewManifest(src string, filter *Filter, prev Manifest) (Manifest, error) {
+	files, _, err := listFiles(src, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(Manifest, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := ManifestEntry{Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode().Perm()}
+		if e, ok := prev[f.rel]; ok && e.Size == entry.Size && e.ModTime.Equal(entry.ModTime) {
+			entry.Sum = e.Sum
+		} else {
+			entry.Sum, err = pathChecksum(f.path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		m[f.rel] = entry
+	}
+
+	return m, nil
+}
+
+// Diff returns the files in m which are missing or different in remote, and the files only in remote.
+// The files with different modes are also returned, because the modes are restored on downloading.
+func (m Manifest) Diff(remote Manifest) ([]string, []string) {
+	var changed, deleted []string
+	for rel, e := range m {
+		if r, ok := remote[rel]; !ok || r.Sum != e.Sum || r.Mode != e.Mode {
+			changed = append(changed, rel)
+		}
+	}
+	for rel := range remote {
+		if _, ok := m[rel]; !ok {
+			deleted = append(deleted, rel)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(deleted)
+
+	return changed, deleted
+}
+
+// UploadFiles uploads only the files of the relative paths in the directory src.
+func UploadFiles(ctx context.Context, s3Client *s3.Client, bucket string, key string, src string, rels []string) ([]string, error) {
+	var files []transferFile
+	var total int64
+	for _, rel := range rels {
+		path := filepath.Join(src, filepath.FromSlash(rel))
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, transferFile{path: path, rel: rel, size: info.Size()})
+		total += info.Size()
+	}
+
+	return uploadFiles(ctx, s3Client, bucket, key, files, total, false)
+}
+
+// DeletionsKey returns the key of the list of the files to delete on syncing, which is outside of the files under the key.
+func DeletionsKey(key string) string {
+	return strings.TrimSuffix(key, "/") + ".deleted"
+}
+
+// PutDeletions uploads the list of the relative paths to delete on syncing.
+func PutDeletions(ctx context.Context, s3Client *s3.Client, bucket string, key string, rels []string) error {
+	b, err := json.Marshal(rels)
+	if err != nil {
+		return err
+	}
+
+	k := DeletionsKey(key)
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &k,
+		Body:   strings.NewReader(string(b)),
+	})
+	return err
+}
+
+// Sync downloads the files under the key into dst, and deletes the files in the list of the key.
+func Sync(ctx context.Context, s3Client *s3.Client, bucket string, key string, dst string) error {
+	keys, err := ListKeys(ctx, s3Client, bucket, key)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		_, err = Download(ctx, s3Client, bucket, key, dst, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	k := DeletionsKey(key)
+	result, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &k,
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	var rels []string
+	err = json.NewDecoder(result.Body).Decode(&rels)
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range rels {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		path := filepath.Join(dst, filepath.FromSlash(rel))
+		// Safety
+		if r, err := filepath.Rel(dst, path); err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("Invalid path: %s", rel)
+		}
+
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Println("Deleted", rel)
+
+		// Remove the directories emptied by the deletion
+		for dir := filepath.Dir(path); dir != filepath.Clean(dst); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	return nil
+}
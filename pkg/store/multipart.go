@@ -0,0 +1,356 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// PartSize is the size of the parts of multipart uploads.
+// Files larger than this are uploaded in parts, so that an interrupted upload can be resumed from the completed parts.
+const PartSize = 8 * 1024 * 1024
+
+// PartConcurrency is the number of parts of a file uploaded at the same time.
+const PartConcurrency = 4
+
+// modeKey is the key of the object metadata for the permission bits of the file in octal.
+const modeKey = "mode"
+
+// partSuffix is appended to the path of the file being downloaded, so that an interrupted download can be resumed.
+const partSuffix = ".ecsk-part"
+
+// uploadFile uploads the file to the key.
+// If resume is true and the object already exists with the same size, or an incomplete multipart upload of the key remains, the upload is resumed.
+func uploadFile(ctx context.Context, s3Client *s3.Client, bucket string, key string, path string, resume bool, p *progress) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	sum, err := fileChecksum(file)
+	if err != nil {
+		return 0, err
+	}
+	metadata := map[string]string{checksumKey: sum, modeKey: strconv.FormatUint(uint64(info.Mode().Perm()), 8)}
+
+	if resume {
+		head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err == nil && head.ContentLength == size && head.Metadata[checksumKey] == sum {
+			p.Resume(size)
+			return size, nil
+		}
+		if err != nil && !isNotFound(err) {
+			return 0, err
+		}
+	}
+
+	if size <= PartSize {
+		_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        &bucket,
+			Key:           &key,
+			Body:          newProgressReader(io.NewSectionReader(file, 0, size), p),
+			ContentLength: size,
+			Metadata:      metadata,
+		})
+		if err != nil {
+			return 0, err
+		}
+		return size, nil
+	}
+
+	var uploadId string
+	var parts map[int32]types.Part
+	if resume {
+		var initiated time.Time
+		uploadId, initiated, parts, err = findMultipartUpload(ctx, s3Client, bucket, key)
+		if err != nil {
+			// Without the permissions to list multipart uploads, just start a new upload.
+			uploadId = ""
+		}
+		// The metadata of the upload has the checksum of the old file, so the upload can't be resumed if the file was changed.
+		if uploadId != "" && (info.ModTime().After(initiated) || !partsMatch(parts, size)) {
+			_, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   &bucket,
+				Key:      &key,
+				UploadId: &uploadId,
+			})
+			if err != nil && !isAPIError(err, "NoSuchUpload") {
+				return 0, err
+			}
+			uploadId = ""
+			parts = nil
+		}
+	}
+	if uploadId == "" {
+		result, err := s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:   &bucket,
+			Key:      &key,
+			Metadata: metadata,
+		})
+		if err != nil {
+			return 0, err
+		}
+		uploadId = *result.UploadId
+	}
+
+	var completed []types.CompletedPart
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, PartConcurrency)
+
+	for i := int32(1); int64(i-1)*PartSize < size; i++ {
+		number := i
+		offset := int64(number-1) * PartSize
+		length := size - offset
+		if length > PartSize {
+			length = PartSize
+		}
+
+		// Skip the parts completed by the previous run
+		if part, ok := parts[number]; ok && part.Size == length {
+			p.Resume(length)
+			completed = append(completed, types.CompletedPart{ETag: part.ETag, PartNumber: number})
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := s3Client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        &bucket,
+				Key:           &key,
+				UploadId:      &uploadId,
+				PartNumber:    number,
+				Body:          newProgressReader(io.NewSectionReader(file, offset, length), p),
+				ContentLength: length,
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			completed = append(completed, types.CompletedPart{ETag: result.ETag, PartNumber: number})
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+
+	// The incomplete upload is not aborted, so that it can be resumed.
+	if len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[i].PartNumber < completed[j].PartNumber
+	})
+	_, err = s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &bucket,
+		Key:             &key,
+		UploadId:        &uploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// findMultipartUpload returns the latest incomplete multipart upload of the key, when it was initiated, and its uploaded parts.
+func findMultipartUpload(ctx context.Context, s3Client *s3.Client, bucket string, key string) (string, time.Time, map[int32]types.Part, error) {
+	result, err := s3Client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: &bucket,
+		Prefix: &key,
+	})
+	if err != nil {
+		return "", time.Time{}, nil, err
+	}
+
+	var upload *types.MultipartUpload
+	for i, u := range result.Uploads {
+		if *u.Key != key {
+			continue
+		}
+		if upload == nil || u.Initiated.After(*upload.Initiated) {
+			upload = &result.Uploads[i]
+		}
+	}
+	if upload == nil {
+		return "", time.Time{}, nil, nil
+	}
+
+	parts := make(map[int32]types.Part)
+	paginator := s3.NewListPartsPaginator(s3Client, &s3.ListPartsInput{
+		Bucket:   &bucket,
+		Key:      &key,
+		UploadId: upload.UploadId,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", time.Time{}, nil, err
+		}
+		for _, part := range page.Parts {
+			parts[part.PartNumber] = part
+		}
+	}
+
+	return *upload.UploadId, *upload.Initiated, parts, nil
+}
+
+// partsMatch reports whether the uploaded parts fit the file of the size, so that they can belong to the same file.
+func partsMatch(parts map[int32]types.Part, size int64) bool {
+	for number, part := range parts {
+		offset := int64(number-1) * PartSize
+		length := size - offset
+		if length > PartSize {
+			length = PartSize
+		}
+		if length <= 0 || part.Size != length {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadFile downloads the object of the key to path through the part file.
+// If the part file remains from the previous run, the download is resumed from its end.
+func downloadFile(ctx context.Context, s3Client *s3.Client, bucket string, key string, path string, size int64, lastModified time.Time, p *progress) (int64, error) {
+	partPath := path + partSuffix
+
+	var offset int64
+	info, err := os.Stat(partPath)
+	// The part file is discarded if the object has been replaced since then.
+	if err == nil && info.Size() <= size && info.ModTime().After(lastModified) {
+		offset = info.Size()
+	}
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	p.Resume(offset)
+	var expected, mode string
+	if offset < size {
+		rng := fmt.Sprintf("bytes=%d-", offset)
+		var result *s3.GetObjectOutput
+		result, err = s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+			Range:  &rng,
+		})
+		if err == nil {
+			expected = result.Metadata[checksumKey]
+			mode = result.Metadata[modeKey]
+			_, err = io.Copy(&progressWriter{w: file, p: p}, result.Body)
+			result.Body.Close()
+		}
+	} else {
+		var head *s3.HeadObjectOutput
+		head, err = s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err == nil {
+			expected = head.Metadata[checksumKey]
+			mode = head.Metadata[modeKey]
+		}
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	// The part file is left for the next run.
+	if err != nil {
+		return 0, err
+	}
+
+	info, err = os.Stat(partPath)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != size {
+		os.Remove(partPath)
+		return 0, fmt.Errorf("Size mismatch: expected %d bytes, but got %d bytes", size, info.Size())
+	}
+
+	// Objects without the checksum (e.g. uploaded by others to the S3 location) are not verified.
+	if expected != "" {
+		err = verifyFile(partPath, expected)
+		if err != nil {
+			os.Remove(partPath)
+			return 0, err
+		}
+	}
+
+	// The mode of the source is restored, or the mode of the replaced file is kept.
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if m, err := strconv.ParseUint(mode, 8, 32); err == nil {
+		perm = os.FileMode(m).Perm()
+	}
+	err = os.Chmod(partPath, perm)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(partPath, path)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestPartsMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts map[int32]types.Part
+		size  int64
+		want  bool
+	}{
+		{name: "no parts", size: PartSize * 2, want: true},
+		{name: "some parts", parts: map[int32]types.Part{1: {Size: PartSize}}, size: PartSize*2 + 1, want: true},
+		{name: "last part", parts: map[int32]types.Part{1: {Size: PartSize}, 3: {Size: 1}}, size: PartSize*2 + 1, want: true},
+		{name: "last part of another size", parts: map[int32]types.Part{3: {Size: 2}}, size: PartSize*2 + 1, want: false},
+		{name: "part beyond the file", parts: map[int32]types.Part{3: {Size: PartSize}}, size: PartSize * 2, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partsMatch(tt.parts, tt.size); got != tt.want {
+				t.Errorf("partsMatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// BucketOptions are applied to all requests for the objects, so that the transfers satisfy locked-down bucket policies.
+type BucketOptions struct {
+	SSE                 string
+	SSEKMSKeyID         string
+	ExpectedBucketOwner string
+}
+
+func (o BucketOptions) Validate() error {
+	switch types.ServerSideEncryption(o.SSE) {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms, "aws:kms:dsse":
+	default:
+		return fmt.Errorf(`Unknown server-side encryption: %s. The accepted values are "AES256", "aws:kms" and "aws:kms:dsse".`, o.SSE)
+	}
+	if o.SSEKMSKeyID != "" && types.ServerSideEncryption(o.SSE) == types.ServerSideEncryptionAes256 {
+		return errors.New("The KMS key can't be used with AES256 encryption.")
+	}
+	return nil
+}
+
+// WithBucketOptions returns the option of the S3 client to apply o to every request.
+func WithBucketOptions(o BucketOptions) func(*s3.Options) {
+	return func(options *s3.Options) {
+		if o == (BucketOptions{}) {
+			return
+		}
+		options.APIOptions = append(options.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("EcskBucketOptions", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				o.apply(in.Parameters)
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+		})
+	}
+}
+
+func (o BucketOptions) apply(params interface{}) {
+	sse := types.ServerSideEncryption(o.SSE)
+	// Specifying the KMS key implies SSE-KMS.
+	if sse == "" && o.SSEKMSKeyID != "" {
+		sse = types.ServerSideEncryptionAwsKms
+	}
+	var keyID, owner *string
+	if o.SSEKMSKeyID != "" {
+		keyID = &o.SSEKMSKeyID
+	}
+	if o.ExpectedBucketOwner != "" {
+		owner = &o.ExpectedBucketOwner
+	}
+
+	// The encryption is specified only on creating objects.
+	switch in := params.(type) {
+	case *s3.PutObjectInput:
+		in.ServerSideEncryption = sse
+		in.SSEKMSKeyId = keyID
+		in.ExpectedBucketOwner = owner
+	case *s3.CreateMultipartUploadInput:
+		in.ServerSideEncryption = sse
+		in.SSEKMSKeyId = keyID
+		in.ExpectedBucketOwner = owner
+	case *s3.UploadPartInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.CompleteMultipartUploadInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.AbortMultipartUploadInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.ListMultipartUploadsInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.ListPartsInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.HeadObjectInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.GetObjectInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.ListObjectsV2Input:
+		in.ExpectedBucketOwner = owner
+	case *s3.DeleteObjectsInput:
+		in.ExpectedBucketOwner = owner
+	case *s3.HeadBucketInput:
+		in.ExpectedBucketOwner = owner
+	}
+}
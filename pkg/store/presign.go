@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const PresignExpires = time.Hour
+
+func PresignGet(ctx context.Context, s3Client *s3.Client, bucket string, key string) (string, http.Header, error) {
+	result, err := s3.NewPresignClient(s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(PresignExpires))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return result.URL, signedHeader(result.SignedHeader), nil
+}
+
+func PresignPut(ctx context.Context, s3Client *s3.Client, bucket string, key string) (string, http.Header, error) {
+	result, err := s3.NewPresignClient(s3Client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(PresignExpires))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return result.URL, signedHeader(result.SignedHeader), nil
+}
+
+// signedHeader returns the signed headers which must be sent with the presigned URL, e.g. for the server-side encryption.
+// Host is set by the HTTP client.
+func signedHeader(h http.Header) http.Header {
+	header := http.Header{}
+	for k, v := range h {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			continue
+		}
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	return header
+}
+
+// GetArchive downloads the tar archive from the presigned URL, and extracts it into dst.
+// No AWS credentials are required.
+func GetArchive(ctx context.Context, url string, header http.Header, dst string, owner bool, filter *Filter) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return httpError(res)
+	}
+
+	p := newProgress("Downloading", res.ContentLength)
+	err = unpack(io.TeeReader(res.Body, &progressWriter{w: io.Discard, p: p}), dst, owner, filter, p)
+	p.Finish()
+	return err
+}
+
+// PutArchive uploads src as a tar archive compressed with the format to the presigned URL.
+// No AWS credentials are required.
+func PutArchive(ctx context.Context, url string, header http.Header, src string, filter *Filter, compress string) error {
+	// Presigned PUT requires the content length, so pack into a temporary file first.
+	file, err := os.CreateTemp("", "ecsk_*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	err = packCompressed(file, src, filter, compress)
+	if err != nil {
+		return err
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	p := newProgress("Uploading", size)
+	defer p.Finish()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, newProgressReader(io.NewSectionReader(file, 0, size), p))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.ContentLength = size
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return httpError(res)
+	}
+
+	p.Println("Uploaded", size, "bytes")
+
+	return nil
+}
+
+func httpError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("%s: %s", res.Status, body)
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const progressWidth = 30
+
+// progress shows a progress bar of the transfer with the rate and ETA.
+// It is used by the cp helper in the container as well, so it doesn't depend on the ui package.
+type progress struct {
+	mu       sync.Mutex
+	verb     string
+	total    int64
+	done     int64
+	resumed  int64
+	start    time.Time
+	rendered time.Time
+	enabled  bool
+}
+
+func newProgress(verb string, total int64) *progress {
+	return &progress{
+		verb:    verb,
+		total:   total,
+		start:   time.Now(),
+		enabled: term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *progress) Add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += n
+	if time.Since(p.rendered) >= 100*time.Millisecond {
+		p.render()
+	}
+}
+
+// Resume counts the bytes transferred by the previous run, which are excluded from the rate.
+func (p *progress) Resume(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += n
+	p.resumed += n
+}
+
+// Println prints the line above the progress bar.
+func (p *progress) Println(a ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	fmt.Println(a...)
+	p.render()
+}
+
+func (p *progress) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+}
+
+func (p *progress) clear() {
+	if p.enabled {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+func (p *progress) render() {
+	if !p.enabled {
+		return
+	}
+	p.rendered = time.Now()
+
+	var rate float64
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed > 0 {
+		rate = float64(p.done-p.resumed) / elapsed
+	}
+
+	line := p.verb
+	if p.total > 0 {
+		ratio := float64(p.done) / float64(p.total)
+		if ratio > 1 {
+			ratio = 1
+		}
+		filled := int(ratio * progressWidth)
+		bar := strings.Repeat("=", filled)
+		if filled < progressWidth {
+			bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+		}
+		line += fmt.Sprintf(" [%s] %3d%% %s / %s", bar, int(ratio*100), formatBytes(p.done), formatBytes(p.total))
+	} else {
+		line += " " + formatBytes(p.done)
+	}
+	line += fmt.Sprintf(" %s/s", formatBytes(int64(rate)))
+	if p.total > 0 && rate > 0 {
+		eta := time.Duration(float64(p.total-p.done)/rate) * time.Second
+		line += " ETA " + eta.Round(time.Second).String()
+	}
+
+	fmt.Fprint(os.Stderr, "\r\033[K"+line)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressReader counts the bytes read from the section.
+// The SDK seeks the body back on retries, so only the bytes beyond the furthest position are counted.
+type progressReader struct {
+	r   *io.SectionReader
+	p   *progress
+	pos int64
+	max int64
+}
+
+func newProgressReader(r *io.SectionReader, p *progress) *progressReader {
+	return &progressReader{r: r, p: p}
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.pos += int64(n)
+	if r.pos > r.max {
+		r.p.Add(r.pos - r.max)
+		r.max = r.pos
+	}
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.r.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// progressWriter counts the bytes written through it.
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TransferID identifies a transfer by its parameters, so that the same transfer can be resumed.
+func TransferID(params ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(params, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// LoadTransferKey returns the key recorded by the previous run of the transfer which didn't complete.
+func LoadTransferKey(id string) (string, bool) {
+	path, err := transferKeyPath(id)
+	if err != nil {
+		return "", false
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+
+	key := strings.TrimSpace(string(b))
+	return key, key != ""
+}
+
+func SaveTransferKey(id string, key string) error {
+	path, err := transferKeyPath(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(key+"\n"), 0600)
+}
+
+func DeleteTransferKey(id string) error {
+	path, err := transferKeyPath(id)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func transferKeyPath(id string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "ecsk", "transfers", id), nil
+}
@@ -2,28 +2,99 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func Upload(ctx context.Context, s3Client *s3.Client, bucket string, key string, src string) ([]string, error) {
-	u := manager.NewUploader(s3Client)
-	var keys []string
+// Concurrency is the number of files transferred at the same time.
+const Concurrency = 16
+
+type transferFile struct {
+	path    string
+	key     string
+	rel     string
+	size    int64
+	modTime time.Time
+}
+
+type transferResult struct {
+	keys   []string
+	files  int
+	bytes  int64
+	failed int
+	err    error
+}
+
+// Upload uploads the files in src under the key.
+// If resume is true, the objects and the multipart uploads left by the previous run are reused.
+func Upload(ctx context.Context, s3Client *s3.Client, bucket string, key string, src string, filter *Filter, resume bool) ([]string, error) {
+	files, total, err := listFiles(src, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return uploadFiles(ctx, s3Client, bucket, key, files, total, resume)
+}
+
+func uploadFiles(ctx context.Context, s3Client *s3.Client, bucket string, key string, files []transferFile, total int64, resume bool) ([]string, error) {
+	for i := range files {
+		files[i].key = path.Join(key, files[i].rel)
+	}
 
-	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	p := newProgress("Uploading", total)
+	result := transfer(ctx, files, func(f transferFile) (int64, error) {
+		n, err := uploadFile(ctx, s3Client, bucket, f.key, f.path, resume, p)
 		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
+			return 0, err
 		}
 
-		file, err := os.Open(path)
+		p.Println("Uploaded", f.rel)
+
+		return n, nil
+	})
+	p.Finish()
+
+	printSummary("Uploaded", result)
+
+	return result.keys, result.err
+}
+
+// DryRun prints the files in src which would be transferred.
+func DryRun(src string, filter *Filter) error {
+	files, total, err := listFiles(src, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		fmt.Println(f.rel)
+	}
+	fmt.Printf("%d files (%d bytes) would be transferred\n", len(files), total)
+
+	return nil
+}
+
+// listFiles walks src and returns the regular files to transfer.
+// The relative paths are slash-separated, or the base name if src is a file.
+func listFiles(src string, filter *Filter) ([]transferFile, int64, error) {
+	src, filter, err := filter.Glob(src)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var files []transferFile
+	var total int64
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -33,68 +104,232 @@ func Upload(ctx context.Context, s3Client *s3.Client, bucket string, key string,
 			return err
 		}
 		if rel == "." {
+			if info.IsDir() {
+				return nil
+			}
 			rel = filepath.Base(path)
 		}
+		rel = filepath.ToSlash(rel)
 
-		k := filepath.ToSlash(filepath.Join(key, rel))
-		keys = append(keys, k)
-
-		_, err = u.Upload(ctx, &s3.PutObjectInput{
-			Bucket: &bucket,
-			Body:   file,
-			Key:    &k,
-		})
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+		if info.IsDir() {
+			if filter.Skip(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !filter.Match(rel, false) {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Upload the target of the symbolic link if it is a file
+			info, err = os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				fmt.Fprintln(os.Stderr, "Skipped", path)
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
 			return nil
 		}
 
-		fmt.Println("Uploaded", strings.Replace(k, key+"/", "", 1))
+		files = append(files, transferFile{
+			path: path,
+			rel:  rel,
+			size: info.Size(),
+		})
+		total += info.Size()
 
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return keys, nil
+	return files, total, nil
 }
 
-func Download(ctx context.Context, s3Client *s3.Client, bucket string, key string, dst string) ([]string, error) {
-	d := manager.NewDownloader(s3Client)
-	var keys []string
+func Download(ctx context.Context, s3Client *s3.Client, bucket string, key string, dst string, filter *Filter) ([]string, error) {
+	var files []transferFile
+	var total int64
 
-	result, err := s3Client.ListObjects(ctx, &s3.ListObjectsInput{
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
 		Bucket: &bucket,
-		Prefix: &key,
+		Prefix: &prefix,
 	})
-	if err != nil {
-		return nil, err
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			k := *c.Key
+			rel := strings.TrimPrefix(k, prefix)
+			if rel == "" || strings.HasSuffix(rel, "/") || !filter.Match(rel, false) {
+				continue
+			}
+
+			path := filepath.Join(dst, filepath.FromSlash(rel))
+			// Safety
+			if r, err := filepath.Rel(dst, path); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+				return nil, fmt.Errorf("Invalid key: %s", k)
+			}
+
+			files = append(files, transferFile{path: path, key: k, rel: rel, size: c.Size, modTime: *c.LastModified})
+			total += c.Size
+		}
+	}
+
+	// The key may be a single object rather than a prefix.
+	if len(files) == 0 && key != "" && !strings.HasSuffix(key, "/") {
+		head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		rel := path.Base(key)
+		if err == nil && filter.Match(rel, false) {
+			files = append(files, transferFile{path: filepath.Join(dst, rel), key: key, rel: rel, size: head.ContentLength, modTime: *head.LastModified})
+			total += head.ContentLength
+		}
 	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No files to download in s3://%s/%s", bucket, key)
+	}
+
+	p := newProgress("Downloading", total)
+	result := transfer(ctx, files, func(f transferFile) (int64, error) {
+		err := os.MkdirAll(filepath.Dir(f.path), 0755)
+		if err != nil {
+			return 0, err
+		}
 
-	for _, c := range result.Contents {
-		path := filepath.Join(dst, filepath.FromSlash(strings.Replace(*c.Key, key, "", 1)))
-		_ = os.MkdirAll(filepath.Dir(path), 0755)
-		file, err := os.Create(path)
+		n, err := downloadFile(ctx, s3Client, bucket, f.key, f.path, f.size, f.modTime, p)
+		if err != nil {
+			return 0, err
+		}
+
+		p.Println("Downloaded", f.rel, n, "bytes")
+
+		return n, nil
+	})
+	p.Finish()
+
+	printSummary("Downloaded", result)
+
+	return result.keys, result.err
+}
+
+// ListKeys returns all keys under the key.
+func ListKeys(ctx context.Context, s3Client *s3.Client, bucket string, key string) ([]string, error) {
+	var keys []string
+
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
+		for _, c := range page.Contents {
+			keys = append(keys, *c.Key)
+		}
+	}
 
-		defer file.Close()
+	return keys, nil
+}
+
+// DeleteKeys deletes the keys, up to 1000 keys per request.
+func DeleteKeys(ctx context.Context, s3Client *s3.Client, bucket string, keys []string) error {
+	for i := 0; i < len(keys); i += 1000 {
+		end := i + 1000
+		if len(keys) < end {
+			end = len(keys)
+		}
 
-		k := *c.Key
-		keys = append(keys, k)
+		var objects []types.ObjectIdentifier
+		for _, k := range keys[i:end] {
+			clone := k
+			objects = append(objects, types.ObjectIdentifier{
+				Key: &clone,
+			})
+		}
 
-		n, err := d.Download(ctx, file, &s3.GetObjectInput{
+		result, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
 			Bucket: &bucket,
-			Key:    &k,
+			Delete: &types.Delete{
+				Objects: objects,
+				Quiet:   true,
+			},
 		})
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+		if len(result.Errors) > 0 {
+			return fmt.Errorf("Failed to delete %s: %s", *result.Errors[0].Key, *result.Errors[0].Message)
 		}
+	}
+
+	return nil
+}
 
-		fmt.Println("Downloaded", strings.Replace(k, key+"/", "", 1), n, "bytes")
+// transfer runs fn for each file with a bounded number of workers, and collects the errors of all files.
+func transfer(ctx context.Context, files []transferFile, fn func(f transferFile) (int64, error)) transferResult {
+	var result transferResult
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	ch := make(chan transferFile)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range ch {
+				n, err := fn(f)
+
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", f.rel, err))
+					result.failed++
+				} else {
+					result.keys = append(result.keys, f.key)
+					result.files++
+					result.bytes += n
+				}
+				mu.Unlock()
+			}
+		}()
 	}
 
-	return keys, nil
+loop:
+	for _, f := range files {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			errs = append(errs, ctx.Err())
+			mu.Unlock()
+			break loop
+		case ch <- f:
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	result.err = errors.Join(errs...)
+	return result
+}
+
+func printSummary(verb string, result transferResult) {
+	if result.failed > 0 {
+		fmt.Fprintf(os.Stderr, "%s %d files (%d bytes), %d failed\n", verb, result.files, result.bytes, result.failed)
+		return
+	}
+	fmt.Printf("%s %d files (%d bytes)\n", verb, result.files, result.bytes)
 }
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CopyArchive writes the tar archive read from r to w as an uncompressed tar archive with only the entries matching the filter.
+// The checksums recorded by Pack are verified and removed, so that other tar commands don't warn about them.
+func CopyArchive(w io.Writer, r io.Reader, filter *Filter) error {
+	dr, err := decompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	tw := tar.NewWriter(w)
+	var mismatches []error
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if !filter.Match(header.Name, header.Typeflag == tar.TypeDir) {
+			continue
+		}
+
+		sum := header.PAXRecords[paxChecksumKey]
+		if sum != "" {
+			delete(header.PAXRecords, paxChecksumKey)
+		}
+
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(tw, h), tr)
+		if err != nil {
+			return err
+		}
+
+		// The entry has already been written, so the mismatches are only reported.
+		if sum != "" {
+			if err := verifyChecksum(sum, hex.EncodeToString(h.Sum(nil))); err != nil {
+				mismatches = append(mismatches, fmt.Errorf("%s: %w", header.Name, err))
+			}
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(mismatches...)
+}
+
+// UploadStream uploads the tar archive read from r to the key, compressed with the format.
+// Compressed archives are also accepted, and they are recompressed with the format.
+func UploadStream(ctx context.Context, s3Client *s3.Client, bucket string, key string, r io.Reader, compress string) error {
+	p := newProgress("Uploading", 0)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(recompress(&progressWriter{w: pw, p: p}, r, compress))
+	}()
+
+	_, err := manager.NewUploader(s3Client).Upload(ctx, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   pr,
+	})
+	pr.Close()
+	p.Finish()
+	return err
+}
+
+func recompress(w io.Writer, r io.Reader, compress string) error {
+	dr, err := decompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	cw, err := compressWriter(w, compress)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(cw, dr)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+
+	return cw.Close()
+}
+
+// DownloadStream downloads the tar archive of the key, and writes it to w with CopyArchive.
+func DownloadStream(ctx context.Context, s3Client *s3.Client, bucket string, key string, w io.Writer) error {
+	result, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	p := newProgress("Downloading", result.ContentLength)
+	err = CopyArchive(w, io.TeeReader(result.Body, &progressWriter{w: io.Discard, p: p}), nil)
+	p.Finish()
+	return err
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"text/tabwriter"
 
 	"github.com/AlecAivazis/survey/v2"
@@ -15,25 +18,48 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/yukiarrr/ecsk/pkg/store"
 )
 
 const (
 	LaunchType int = iota
 	Cluster
+	Service
 	TaskDefinition
+	TaskDefinitionRevision
 	Vpc
 	Subnets
 	SecurityGroups
+	Overrides
 	Task
 	Tasks
 	Container
+	DstTask
+	DstContainer
 	Bucket
 	Complete
 )
 
+// promptOutput is where the prompts are rendered.
+var promptOutput = os.Stdout
+
+// PromptToStderr renders the prompts to stderr, so that stdout is left for the data written by the command.
+func PromptToStderr() {
+	promptOutput = os.Stderr
+}
+
+func askOne(p survey.Prompt, response interface{}, opts ...survey.AskOpt) error {
+	return survey.AskOne(p, response, append(opts, survey.WithStdio(os.Stdin, promptOutput, os.Stderr))...)
+}
+
 const Back = "← Back"
 const NewBucket = "→ New Bucket"
+const AllTasks = "→ All Tasks"
+
+// NoServices is returned by AskService without asking if the cluster has no services.
+const NoServices = "→ No Services"
+const StoppedTasks = "→ Stopped Tasks"
+const RunningTasks = "→ Running Tasks"
 
 func AskLaunchType(ecsClient *ecs.Client, addBack bool) (string, error) {
 	var launchTypes []string
@@ -48,7 +74,7 @@ func AskLaunchType(ecsClient *ecs.Client, addBack bool) (string, error) {
 	}
 
 	var launchType string
-	err := survey.AskOne(prompt, &launchType)
+	err := askOne(prompt, &launchType)
 	if err != nil {
 		return "", err
 	}
@@ -95,7 +121,7 @@ func AskCluster(ctx context.Context, ecsClient *ecs.Client, addBack bool) (strin
 	}
 
 	var cluster string
-	err := survey.AskOne(prompt, &cluster)
+	err := askOne(prompt, &cluster)
 	if err != nil {
 		return "", err
 	}
@@ -106,14 +132,134 @@ func AskCluster(ctx context.Context, ecsClient *ecs.Client, addBack bool) (strin
 	return cluster, nil
 }
 
-func AskTaskDefinition(ctx context.Context, ecsClient *ecs.Client, addBack bool) (string, error) {
-	result, err := ecsClient.ListTaskDefinitionFamilies(ctx, &ecs.ListTaskDefinitionFamiliesInput{
-		Status: "ACTIVE",
+// AskService returns AllTasks to choose from all tasks in the cluster, including the tasks which don't belong to services.
+// If the cluster has no services, NoServices is returned without asking.
+func AskService(ctx context.Context, ecsClient *ecs.Client, cluster string, addBack bool) (string, error) {
+	var serviceArns []string
+	var nextToken *string
+
+	for {
+		result, err := ecsClient.ListServices(ctx, &ecs.ListServicesInput{
+			Cluster:   &cluster,
+			NextToken: nextToken,
+		})
+		if err != nil {
+			return "", err
+		}
+		serviceArns = append(serviceArns, result.ServiceArns...)
+
+		if result.NextToken == nil {
+			break
+		}
+		nextToken = result.NextToken
+	}
+	if len(serviceArns) == 0 {
+		return NoServices, nil
+	}
+
+	var services []ecstypes.Service
+	for i := 0; i < len(serviceArns); i += 10 {
+		end := i + 10
+		if len(serviceArns) < end {
+			end = len(serviceArns)
+		}
+
+		describeResult, err := ecsClient.DescribeServices(ctx, &ecs.DescribeServicesInput{
+			Cluster:  &cluster,
+			Services: serviceArns[i:end],
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(describeResult.Failures) > 0 {
+			return "", fmt.Errorf("%v", describeResult.Failures)
+		}
+		services = append(services, describeResult.Services...)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return *services[i].ServiceName < *services[j].ServiceName
 	})
+
+	b := strings.Builder{}
+	w := tabwriter.NewWriter(&b, 0, 0, 1, ' ', tabwriter.Debug)
+	var serviceNames []string
+	for _, s := range services {
+		fmt.Fprintf(w, "%s\t Desired: %d\t Running: %d\t Pending: %d\n", *s.ServiceName, s.DesiredCount, s.RunningCount, s.PendingCount)
+		serviceNames = append(serviceNames, *s.ServiceName)
+	}
+	w.Flush()
+
+	var opts []string
+	if addBack {
+		opts = []string{Back}
+	}
+	opts = append(opts, AllTasks)
+	opts = append(opts, strings.Split(b.String(), "\n")...)
+	prompt := &survey.Select{
+		Message: fmt.Sprintf("Choose Service %s:", Yellow("(Already filtered by Cluster)")),
+		Options: opts[:len(opts)-1],
+	}
+
+	var i int
+	err := askOne(prompt, &i)
 	if err != nil {
 		return "", err
 	}
-	if len(result.Families) == 0 {
+	if addBack {
+		if i == 0 {
+			return "", nil
+		}
+		i--
+	}
+	if i == 0 {
+		return AllTasks, nil
+	}
+
+	return serviceNames[i-1], nil
+}
+
+// FindServiceTask returns the running task of the service if it's the only one.
+// Empty is returned if the service has several tasks, so that the task is chosen with AskTask.
+func FindServiceTask(ctx context.Context, ecsClient *ecs.Client, cluster string, service string) (string, error) {
+	result, err := ecsClient.ListTasks(ctx, &ecs.ListTasksInput{
+		Cluster:       &cluster,
+		ServiceName:   &service,
+		DesiredStatus: ecstypes.DesiredStatusRunning,
+		MaxResults:    aws.Int32(2),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(result.TaskArns) == 0 {
+		return "", fmt.Errorf("No Task of %s exists.", service)
+	}
+	if len(result.TaskArns) > 1 {
+		return "", nil
+	}
+
+	return path.Base(result.TaskArns[0]), nil
+}
+
+func AskTaskDefinition(ctx context.Context, ecsClient *ecs.Client, addBack bool) (string, error) {
+	var result []string
+	var nextToken *string
+
+	for {
+		listResult, err := ecsClient.ListTaskDefinitionFamilies(ctx, &ecs.ListTaskDefinitionFamiliesInput{
+			Status:    "ACTIVE",
+			NextToken: nextToken,
+		})
+		if err != nil {
+			return "", err
+		}
+		result = append(result, listResult.Families...)
+
+		if listResult.NextToken == nil {
+			break
+		}
+		nextToken = listResult.NextToken
+	}
+	if len(result) == 0 {
 		return "", errors.New("No Task Definition exists.")
 	}
 
@@ -121,7 +267,7 @@ func AskTaskDefinition(ctx context.Context, ecsClient *ecs.Client, addBack bool)
 	if addBack {
 		families = []string{Back}
 	}
-	families = append(families, result.Families...)
+	families = append(families, result...)
 
 	prompt := &survey.Select{
 		Message: "Choose Task Definition:",
@@ -129,7 +275,7 @@ func AskTaskDefinition(ctx context.Context, ecsClient *ecs.Client, addBack bool)
 	}
 
 	var taskDefinition string
-	err = survey.AskOne(prompt, &taskDefinition)
+	err := askOne(prompt, &taskDefinition)
 	if err != nil {
 		return "", err
 	}
@@ -140,6 +286,128 @@ func AskTaskDefinition(ctx context.Context, ecsClient *ecs.Client, addBack bool)
 	return taskDefinition, nil
 }
 
+// AskTaskDefinitionRevision returns the chosen revision as "family:revision". The latest revision is the default.
+// Only the latest revisions are described, and the older ones are listed without details.
+func AskTaskDefinitionRevision(ctx context.Context, ecsClient *ecs.Client, family string, addBack bool) (string, error) {
+	const maxDescribed = 20
+
+	var revisions []string
+	var nextToken *string
+
+	for {
+		result, err := ecsClient.ListTaskDefinitions(ctx, &ecs.ListTaskDefinitionsInput{
+			FamilyPrefix: &family,
+			Status:       ecstypes.TaskDefinitionStatusActive,
+			Sort:         ecstypes.SortOrderDesc,
+			NextToken:    nextToken,
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, arn := range result.TaskDefinitionArns {
+			// FamilyPrefix also matches the other families starting with the family
+			revision := path.Base(arn)
+			if f, _, _ := strings.Cut(revision, ":"); f == family {
+				revisions = append(revisions, revision)
+			}
+		}
+
+		if result.NextToken == nil {
+			break
+		}
+		nextToken = result.NextToken
+	}
+	if len(revisions) == 0 {
+		return "", errors.New("No Task Definition exists.")
+	}
+
+	described := make([]*ecstypes.TaskDefinition, len(revisions))
+	errs := make([]error, len(revisions))
+	var wg sync.WaitGroup
+	for i := 0; i < len(revisions) && i < maxDescribed; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			result, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+				TaskDefinition: &revisions[i],
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			described[i] = result.TaskDefinition
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+
+	b := strings.Builder{}
+	w := tabwriter.NewWriter(&b, 0, 0, 1, ' ', tabwriter.Debug)
+	for i, r := range revisions {
+		if i == 0 {
+			r += " (latest)"
+		}
+		td := described[i]
+		if td == nil {
+			fmt.Fprintf(w, "%s\t -\t -\t -\n", r)
+			continue
+		}
+
+		registeredAt := "-"
+		if td.RegisteredAt != nil {
+			registeredAt = td.RegisteredAt.Format("2006/1/2 15:04:05")
+		}
+		var images []string
+		for _, c := range td.ContainerDefinitions {
+			if c.Image != nil {
+				images = append(images, path.Base(*c.Image))
+			}
+		}
+		cpu, memory := "-", "-"
+		if td.Cpu != nil {
+			cpu = *td.Cpu
+		}
+		if td.Memory != nil {
+			memory = *td.Memory
+		}
+		fmt.Fprintf(w, "%s\t %s\t %s\t CPU: %s, Memory: %s\n", r, registeredAt, truncate(strings.Join(images, ", ")), cpu, memory)
+	}
+	w.Flush()
+
+	rows := strings.Split(b.String(), "\n")
+	rows = rows[:len(rows)-1]
+
+	var opts []string
+	if addBack {
+		opts = []string{Back}
+	}
+	opts = append(opts, rows...)
+	prompt := &survey.Select{
+		Message: fmt.Sprintf("Choose Revision %s:", Yellow("(Already filtered by Task Definition)")),
+		Options: opts,
+		Default: rows[0],
+	}
+
+	var i int
+	err := askOne(prompt, &i)
+	if err != nil {
+		return "", err
+	}
+	if addBack {
+		if i == 0 {
+			return "", nil
+		}
+		i--
+	}
+
+	return revisions[i], nil
+}
+
 func AskVpc(ctx context.Context, ec2Client *ec2.Client, addBack bool) (string, error) {
 	result, err := ec2Client.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{})
 	if err != nil {
@@ -169,7 +437,7 @@ func AskVpc(ctx context.Context, ec2Client *ec2.Client, addBack bool) (string, e
 	}
 
 	var i int
-	err = survey.AskOne(prompt, &i)
+	err = askOne(prompt, &i)
 	if err != nil {
 		return "", err
 	}
@@ -207,7 +475,7 @@ func AskSubnets(ctx context.Context, ec2Client *ec2.Client, vpc string) ([]strin
 	}
 
 	var i []int
-	err = survey.AskOne(prompt, &i)
+	err = askOne(prompt, &i)
 	if err != nil {
 		return nil, err
 	}
@@ -249,7 +517,7 @@ func AskSecurityGroups(ctx context.Context, ec2Client *ec2.Client, vpc string) (
 	}
 
 	var i []int
-	err = survey.AskOne(prompt, &i)
+	err = askOne(prompt, &i)
 	if err != nil {
 		return nil, err
 	}
@@ -264,109 +532,165 @@ func AskSecurityGroups(ctx context.Context, ec2Client *ec2.Client, vpc string) (
 	return securityGroups, nil
 }
 
-func AskTask(ctx context.Context, ecsClient *ecs.Client, cluster string, addBack bool) (string, error) {
-	listResult, err := ecsClient.ListTasks(ctx, &ecs.ListTasksInput{
-		Cluster: &cluster,
-	})
+// AskTask shows only the tasks of the service unless the service is empty, AllTasks or NoServices.
+func AskTask(ctx context.Context, ecsClient *ecs.Client, cluster string, service string, addBack bool) (string, error) {
+	tasks, err := listTasks(ctx, ecsClient, cluster, service, ecstypes.DesiredStatusRunning)
 	if err != nil {
 		return "", err
 	}
-	listSize := len(listResult.TaskArns)
-	if len(listResult.TaskArns) == 0 {
+	if len(tasks) == 0 {
 		return "", errors.New("No Task exists.")
 	}
 
-	var taskArnsList [][]string
-	for i := 0; i < listSize; i += 100 {
-		end := i + 100
-		if listSize < end {
-			end = listSize
+	rows, taskIds := formatTasks(tasks)
+
+	var opts []string
+	if addBack {
+		opts = []string{Back}
+	}
+	opts = append(opts, rows...)
+	prompt := &survey.Select{
+		Message: fmt.Sprintf("Choose Task %s:", Yellow(filteredBy(service))),
+		Options: opts,
+	}
+
+	var i int
+	err = askOne(prompt, &i)
+	if err != nil {
+		return "", err
+	}
+	if addBack {
+		if i == 0 {
+			return "", nil
 		}
-		taskArnsList = append(taskArnsList, listResult.TaskArns[i:end])
+		i--
 	}
 
-	var tasks []ecstypes.Task
-	for _, t := range taskArnsList {
-		describeResult, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
-			Cluster: &cluster,
-			Tasks:   t,
-		})
+	return taskIds[i], nil
+}
+
+// AskTasks lists the running tasks.
+// If withStopped is true, the list can be switched to the recently stopped tasks, and the tasks selected in both lists are returned.
+func AskTasks(ctx context.Context, ecsClient *ecs.Client, cluster string, service string, withStopped bool) ([]string, error) {
+	status := ecstypes.DesiredStatusRunning
+	var selected []string
+
+	for {
+		tasks, err := listTasks(ctx, ecsClient, cluster, service, status)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if len(describeResult.Failures) > 0 {
-			return "", fmt.Errorf("%v", describeResult.Failures)
+		if len(tasks) == 0 && !withStopped {
+			return nil, errors.New("No Task exists.")
 		}
-		tasks = append(tasks, describeResult.Tasks...)
-	}
 
-	b := strings.Builder{}
-	w := tabwriter.NewWriter(&b, 0, 0, 1, ' ', tabwriter.Debug)
-	var taskIds []string
-	for _, t := range tasks {
-		taskId := path.Base(*t.TaskArn)
-		ipAddress := "-"
-		for _, a := range t.Attachments {
-			for _, d := range a.Details {
-				if d.Name == nil || *d.Name != "privateIPv4Address" {
+		rows, taskIds := formatTasks(tasks)
+
+		var opts []string
+		message := "Choose Tasks"
+		if withStopped {
+			opts = []string{toggleOption(status)}
+			if status == ecstypes.DesiredStatusStopped {
+				message = "Choose Stopped Tasks"
+			}
+		}
+		// The tasks selected before switching the list are kept selected
+		listed := make(map[string]bool)
+		var defaults []int
+		for j, id := range taskIds {
+			listed[id] = true
+			for _, s := range selected {
+				if s == id {
+					defaults = append(defaults, len(opts)+j)
+				}
+			}
+		}
+		opts = append(opts, rows...)
+		prompt := &survey.MultiSelect{
+			Message: fmt.Sprintf("%s %s:", message, Yellow(filteredBy(service))),
+			Options: opts,
+			Default: defaults,
+		}
+
+		var i []int
+		err = askOne(prompt, &i)
+		if err != nil {
+			return nil, err
+		}
+		var kept []string
+		for _, s := range selected {
+			if !listed[s] {
+				kept = append(kept, s)
+			}
+		}
+		selected = kept
+		toggled := false
+		for _, v := range i {
+			if withStopped {
+				if v == 0 {
+					toggled = true
 					continue
 				}
-				ipAddress = *d.Value
+				v--
 			}
+			selected = append(selected, taskIds[v])
+		}
+		if toggled {
+			status = toggleStatus(status)
+			continue
+		}
+		if len(selected) == 0 {
+			return nil, nil
 		}
-		fmt.Fprintf(w, "%s\t %s\t %s\t %s\t %s\t %s\n", taskId, truncate(path.Base(*t.TaskDefinitionArn)), *t.LastStatus, t.CreatedAt.Format("2006/1/2 15:04:05"), truncate(*t.Group), ipAddress)
-		taskIds = append(taskIds, taskId)
-	}
-	w.Flush()
 
-	var opts []string
-	if addBack {
-		opts = []string{Back}
-	}
-	opts = append(opts, strings.Split(b.String(), "\n")...)
-	prompt := &survey.Select{
-		Message: fmt.Sprintf("Choose Task %s:", Yellow("(Already filtered by Cluster)")),
-		Options: opts[:len(opts)-1],
+		return selected, nil
 	}
+}
 
-	var i int
-	err = survey.AskOne(prompt, &i)
-	if err != nil {
-		return "", err
-	}
-	if i == 0 {
-		return "", nil
+func toggleOption(status ecstypes.DesiredStatus) string {
+	if status == ecstypes.DesiredStatusRunning {
+		return StoppedTasks
 	}
-
-	return taskIds[i-1], nil
+	return RunningTasks
 }
 
-func AskTasks(ctx context.Context, ecsClient *ecs.Client, cluster string) ([]string, error) {
-	listResult, err := ecsClient.ListTasks(ctx, &ecs.ListTasksInput{
-		Cluster: &cluster,
-	})
-	if err != nil {
-		return nil, err
+func toggleStatus(status ecstypes.DesiredStatus) ecstypes.DesiredStatus {
+	if status == ecstypes.DesiredStatusRunning {
+		return ecstypes.DesiredStatusStopped
 	}
-	listSize := len(listResult.TaskArns)
-	if len(listResult.TaskArns) == 0 {
-		return nil, errors.New("No Task exists.")
+	return ecstypes.DesiredStatusRunning
+}
+
+// listTasks lists the tasks of all pages with the desired status.
+// Stopped tasks are listed only for a while after they stopped.
+func listTasks(ctx context.Context, ecsClient *ecs.Client, cluster string, service string, status ecstypes.DesiredStatus) ([]ecstypes.Task, error) {
+	input := listTasksInput(cluster, service)
+	input.DesiredStatus = status
+
+	var taskArns []string
+	for {
+		result, err := ecsClient.ListTasks(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		taskArns = append(taskArns, result.TaskArns...)
+
+		if result.NextToken == nil {
+			break
+		}
+		input.NextToken = result.NextToken
 	}
 
-	var taskArnsList [][]string
-	for i := 0; i < listSize; i += 100 {
+	var tasks []ecstypes.Task
+	for i := 0; i < len(taskArns); i += 100 {
 		end := i + 100
-		if listSize < end {
-			end = listSize
+		if len(taskArns) < end {
+			end = len(taskArns)
 		}
-		taskArnsList = append(taskArnsList, listResult.TaskArns[i:end])
-	}
 
-	var describeTasks []ecstypes.Task
-	for _, t := range taskArnsList {
 		describeResult, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{
 			Cluster: &cluster,
-			Tasks:   t,
+			Tasks:   taskArns[i:end],
 		})
 		if err != nil {
 			return nil, err
@@ -374,14 +698,17 @@ func AskTasks(ctx context.Context, ecsClient *ecs.Client, cluster string) ([]str
 		if len(describeResult.Failures) > 0 {
 			return nil, fmt.Errorf("%v", describeResult.Failures)
 		}
-
-		describeTasks = append(describeTasks, describeResult.Tasks...)
+		tasks = append(tasks, describeResult.Tasks...)
 	}
 
+	return tasks, nil
+}
+
+func formatTasks(tasks []ecstypes.Task) ([]string, []string) {
 	b := strings.Builder{}
 	w := tabwriter.NewWriter(&b, 0, 0, 1, ' ', tabwriter.Debug)
 	var taskIds []string
-	for _, t := range describeTasks {
+	for _, t := range tasks {
 		taskId := path.Base(*t.TaskArn)
 		ipAddress := "-"
 		for _, a := range t.Attachments {
@@ -397,26 +724,25 @@ func AskTasks(ctx context.Context, ecsClient *ecs.Client, cluster string) ([]str
 	}
 	w.Flush()
 
-	opts := strings.Split(b.String(), "\n")
-	prompt := &survey.MultiSelect{
-		Message: fmt.Sprintf("Choose Tasks %s:", Yellow("(Already filtered by Cluster)")),
-		Options: opts[:len(opts)-1],
-	}
+	rows := strings.Split(b.String(), "\n")
+	return rows[:len(rows)-1], taskIds
+}
 
-	var i []int
-	err = survey.AskOne(prompt, &i)
-	if err != nil {
-		return nil, err
+func listTasksInput(cluster string, service string) *ecs.ListTasksInput {
+	input := &ecs.ListTasksInput{
+		Cluster: &cluster,
 	}
-	var tasks []string
-	for _, v := range i {
-		tasks = append(tasks, taskIds[v])
-	}
-	if len(tasks) == 0 {
-		return nil, nil
+	if filtersService(service) {
+		input.ServiceName = &service
 	}
+	return input
+}
 
-	return tasks, nil
+func filteredBy(service string) string {
+	if filtersService(service) {
+		return "(Already filtered by Service)"
+	}
+	return "(Already filtered by Cluster)"
 }
 
 func AskContainer(ctx context.Context, ecsClient *ecs.Client, cluster string, task string, addBack bool) (string, error) {
@@ -451,7 +777,7 @@ func AskContainer(ctx context.Context, ecsClient *ecs.Client, cluster string, ta
 	}
 
 	var container string
-	err = survey.AskOne(prompt, &container)
+	err = askOne(prompt, &container)
 	if err != nil {
 		return "", err
 	}
@@ -482,7 +808,7 @@ func AskBucket(ctx context.Context, s3Client *s3.Client, region string, addBack
 	}
 
 	var bucket string
-	err = survey.AskOne(selectPrompt, &bucket)
+	err = askOne(selectPrompt, &bucket)
 	if err != nil {
 		return "", err
 	}
@@ -495,17 +821,12 @@ func AskBucket(ctx context.Context, s3Client *s3.Client, region string, addBack
 			Message: "Input Bucket Name:",
 		}
 
-		err := survey.AskOne(inputPrompt, &bucket)
+		err := askOne(inputPrompt, &bucket)
 		if err != nil {
 			return "", err
 		}
 
-		_, err = s3Client.CreateBucket(ctx, &s3.CreateBucketInput{
-			Bucket: &bucket,
-			CreateBucketConfiguration: &s3types.CreateBucketConfiguration{
-				LocationConstraint: s3types.BucketLocationConstraint(region),
-			},
-		})
+		err = store.SetupBucket(ctx, s3Client, bucket, region)
 		if err != nil {
 			return "", err
 		}
@@ -530,3 +851,7 @@ func truncate(text string) string {
 	}
 	return text
 }
+
+func filtersService(service string) bool {
+	return service != "" && service != AllTasks && service != NoServices
+}
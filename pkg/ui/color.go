@@ -5,4 +5,5 @@ import "github.com/fatih/color"
 var (
 	Yellow = color.New(color.FgYellow).SprintFunc()
 	Green  = color.New(color.FgGreen).SprintFunc()
+	Red    = color.New(color.FgRed).SprintFunc()
 )
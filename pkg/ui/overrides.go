@@ -0,0 +1,238 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/kballard/go-shellquote"
+)
+
+const (
+	overrideDone             = "→ Done"
+	overrideCommand          = "Command"
+	overrideEnvironment      = "Environment Variables"
+	overrideCpu              = "Task CPU"
+	overrideMemory           = "Task Memory"
+	overrideTaskRole         = "Task Role"
+	overrideExecutionRole    = "Execution Role"
+	overrideEphemeralStorage = "Ephemeral Storage"
+)
+
+// AskOverrides builds the overrides interactively from the container definitions of the task definition.
+// Nil is returned for Back.
+func AskOverrides(ctx context.Context, ecsClient *ecs.Client, taskDefinition string, addBack bool) (*ecstypes.TaskOverride, error) {
+	result, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefinition,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []string
+	for _, c := range result.TaskDefinition.ContainerDefinitions {
+		containers = append(containers, *c.Name)
+	}
+
+	var opts []string
+	if addBack {
+		opts = []string{Back}
+	}
+	opts = append(opts, overrideDone, overrideCommand, overrideEnvironment, overrideCpu, overrideMemory, overrideTaskRole, overrideExecutionRole, overrideEphemeralStorage)
+
+	overrides := &ecstypes.TaskOverride{}
+	for {
+		prompt := &survey.Select{
+			Message: fmt.Sprintf("Override Task %s:", Yellow("(Choose → Done to run the task)")),
+			Options: opts,
+		}
+
+		var item string
+		err := askOne(prompt, &item)
+		if err != nil {
+			return nil, err
+		}
+
+		switch item {
+		case Back:
+			return nil, nil
+		case overrideDone:
+			return overrides, nil
+		case overrideCommand:
+			container, err := askOverrideContainer(containers)
+			if err != nil {
+				return nil, err
+			}
+
+			o := containerOverride(overrides, container)
+			var command string
+			err = askOne(&survey.Input{
+				Message: fmt.Sprintf("Input Command %s:", Yellow(currentHint(shellquote.Join(o.Command...), "empty to use the task definition"))),
+			}, &command, survey.WithValidator(func(ans interface{}) error {
+				_, err := shellquote.Split(ans.(string))
+				return err
+			}))
+			if err != nil {
+				return nil, err
+			}
+
+			o.Command, _ = shellquote.Split(command)
+		case overrideEnvironment:
+			container, err := askOverrideContainer(containers)
+			if err != nil {
+				return nil, err
+			}
+
+			o := containerOverride(overrides, container)
+			for {
+				var env string
+				err := askOne(&survey.Input{
+					Message: fmt.Sprintf("Input Environment Variable %s:", Yellow("(KEY=VALUE, -KEY to remove, empty to finish)")),
+				}, &env, survey.WithValidator(func(ans interface{}) error {
+					if s := ans.(string); s != "" && !strings.Contains(s, "=") && !strings.HasPrefix(s, "-") {
+						return errors.New("Need KEY=VALUE or -KEY.")
+					}
+					return nil
+				}))
+				if err != nil {
+					return nil, err
+				}
+				if env == "" {
+					break
+				}
+				if name, ok := strings.CutPrefix(env, "-"); ok && !strings.Contains(name, "=") {
+					o.Environment = removeEnvironment(o.Environment, name)
+					continue
+				}
+
+				name, value, _ := strings.Cut(env, "=")
+				o.Environment = SetEnvironment(o.Environment, name, value)
+			}
+		case overrideCpu:
+			overrides.Cpu, err = askOverrideValue("Input Task CPU", "(e.g. 1024)", overrides.Cpu)
+		case overrideMemory:
+			overrides.Memory, err = askOverrideValue("Input Task Memory", "(e.g. 2048)", overrides.Memory)
+		case overrideTaskRole:
+			overrides.TaskRoleArn, err = askOverrideValue("Input Task Role ARN", "", overrides.TaskRoleArn)
+		case overrideExecutionRole:
+			overrides.ExecutionRoleArn, err = askOverrideValue("Input Execution Role ARN", "", overrides.ExecutionRoleArn)
+		case overrideEphemeralStorage:
+			var current string
+			if overrides.EphemeralStorage != nil {
+				current = strconv.Itoa(int(overrides.EphemeralStorage.SizeInGiB))
+			}
+			var size string
+			err = askOne(&survey.Input{
+				Message: fmt.Sprintf("Input Ephemeral Storage %s %s:", Yellow("(GiB, 21-200)"), Yellow(currentHint(current, "empty to use the task definition"))),
+			}, &size, survey.WithValidator(func(ans interface{}) error {
+				if s := ans.(string); s != "" {
+					if n, err := strconv.Atoi(s); err != nil || n < 21 || n > 200 {
+						return errors.New("Need a number from 21 to 200.")
+					}
+				}
+				return nil
+			}))
+			if err != nil {
+				return nil, err
+			}
+
+			overrides.EphemeralStorage = nil
+			if size != "" {
+				n, _ := strconv.Atoi(size)
+				overrides.EphemeralStorage = &ecstypes.EphemeralStorage{SizeInGiB: int32(n)}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// SetEnvironment sets the environment variable, replacing the one with the same name.
+func SetEnvironment(environment []ecstypes.KeyValuePair, name string, value string) []ecstypes.KeyValuePair {
+	for i, e := range environment {
+		if e.Name != nil && *e.Name == name {
+			environment[i].Value = &value
+			return environment
+		}
+	}
+	return append(environment, ecstypes.KeyValuePair{Name: &name, Value: &value})
+}
+
+func removeEnvironment(environment []ecstypes.KeyValuePair, name string) []ecstypes.KeyValuePair {
+	var result []ecstypes.KeyValuePair
+	for _, e := range environment {
+		if e.Name == nil || *e.Name != name {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func askOverrideContainer(containers []string) (string, error) {
+	if len(containers) == 1 {
+		return containers[0], nil
+	}
+
+	prompt := &survey.Select{
+		Message: "Choose Container:",
+		Options: containers,
+	}
+
+	var container string
+	err := askOne(prompt, &container)
+	if err != nil {
+		return "", err
+	}
+
+	return container, nil
+}
+
+// askOverrideValue returns nil for empty input to use the value of the task definition.
+func askOverrideValue(message string, hint string, current *string) (*string, error) {
+	var c string
+	if current != nil {
+		c = *current
+	}
+
+	if hint != "" {
+		message += " " + Yellow(hint)
+	}
+
+	var value string
+	err := askOne(&survey.Input{
+		Message: fmt.Sprintf("%s %s:", message, Yellow(currentHint(c, "empty to use the task definition"))),
+	}, &value)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	return &value, nil
+}
+
+// currentHint shows the current value, which isn't used as the default so that empty input clears it.
+func currentHint(current string, empty string) string {
+	if current == "" {
+		return fmt.Sprintf("(%s)", strings.ToUpper(empty[:1])+empty[1:])
+	}
+	return fmt.Sprintf("(Current: %s, %s)", current, empty)
+}
+
+func containerOverride(overrides *ecstypes.TaskOverride, container string) *ecstypes.ContainerOverride {
+	for i, o := range overrides.ContainerOverrides {
+		if o.Name != nil && *o.Name == container {
+			return &overrides.ContainerOverrides[i]
+		}
+	}
+
+	overrides.ContainerOverrides = append(overrides.ContainerOverrides, ecstypes.ContainerOverride{Name: &container})
+	return &overrides.ContainerOverrides[len(overrides.ContainerOverrides)-1]
+}
@@ -1,19 +1,47 @@
 package util
 
 import (
+	"io"
 	"os"
 	"os/exec"
 )
 
 func ExecCommand(name string, arg ...string) error {
+	return ExecCommandWithStdout(os.Stdout, name, arg...)
+}
+
+func ExecCommandWithStdout(stdout io.Writer, name string, arg ...string) error {
+	return ExecCommandWithStdio(os.Stdin, stdout, name, arg...)
+}
+
+// ExecCommandWithStdio doesn't wait for stdin to reach EOF after the command exits, unlike exec.Cmd.
+func ExecCommandWithStdio(stdin io.Reader, stdout io.Writer, name string, arg ...string) error {
 	cmd := exec.Command(name, arg...)
 	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
-	err := cmd.Run()
+	cmd.Stdout = stdout
+
+	if f, ok := stdin.(*os.File); ok {
+		cmd.Stdin = f
+		return cmd.Run()
+	}
+
+	r, w, err := os.Pipe()
 	if err != nil {
 		return err
 	}
+	cmd.Stdin = r
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	// The copy ends when stdin reaches EOF or the command exits
+	go func() {
+		io.Copy(w, stdin)
+		w.Close()
+	}()
 
-	return nil
+	return cmd.Wait()
 }
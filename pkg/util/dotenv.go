@@ -0,0 +1,69 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadEnvFile reads the dotenv file, and returns the variables as KEY=VALUE in order.
+// Blank lines, comments and the "export" prefix are ignored, and quoted values are unquoted.
+func ReadEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var envs []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: Need KEY=VALUE.", path, n)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil || !isComment(value[len(quoted):]) {
+				return nil, fmt.Errorf("%s:%d: Invalid quoted value.", path, n)
+			}
+			value, _ = strconv.Unquote(quoted)
+		case strings.HasPrefix(value, "'"):
+			i := strings.Index(value[1:], "'")
+			if i < 0 || !isComment(value[i+2:]) {
+				return nil, fmt.Errorf("%s:%d: Invalid quoted value.", path, n)
+			}
+			value = value[1 : i+1]
+		default:
+			// Inline comments are allowed only for unquoted values
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+
+		envs = append(envs, name+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return envs, nil
+}
+
+// isComment reports whether the rest after a quoted value is empty or a comment.
+func isComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
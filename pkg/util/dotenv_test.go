@@ -0,0 +1,92 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{name: "plain", content: "A=1\nB=two\n", want: []string{"A=1", "B=two"}},
+		{name: "empty value", content: "A=\n", want: []string{"A="}},
+		{name: "empty quoted value", content: `A=""` + "\n", want: []string{"A="}},
+		{name: "export with empty value", content: "export A=\n", want: []string{"A="}},
+		{name: "equal sign in value", content: "A=b=c\n", want: []string{"A=b=c"}},
+		{name: "spaces around", content: "  A = 1  \n", want: []string{"A=1"}},
+		{name: "blank lines and comments", content: "\n# comment\n  # indented\nA=1\n\n", want: []string{"A=1"}},
+		{name: "export prefix", content: "export A=1\n", want: []string{"A=1"}},
+		{name: "inline comment", content: "A=1 # comment\n", want: []string{"A=1"}},
+		{name: "hash without space", content: "A=a#b\n", want: []string{"A=a#b"}},
+		{name: "double quotes", content: `A="a b"` + "\n", want: []string{"A=a b"}},
+		{name: "double quotes with escapes", content: `A="a\nb\t\"c\"\\"` + "\n", want: []string{"A=a\nb\t\"c\"\\"}},
+		{name: "double quotes with comment", content: `A="a # b" # comment` + "\n", want: []string{"A=a # b"}},
+		{name: "single quotes", content: `A='a b'` + "\n", want: []string{"A=a b"}},
+		{name: "single quotes are literal", content: `A='a\nb $C'` + "\n", want: []string{`A=a\nb $C`}},
+		{name: "single quotes with comment", content: `A='a # b' # comment` + "\n", want: []string{"A=a # b"}},
+		{name: "order and duplicates", content: "B=1\nA=2\nB=3\n", want: []string{"B=1", "A=2", "B=3"}},
+		{name: "duplicate cleared", content: "A=1\nA=\n", want: []string{"A=1", "A="}},
+		{name: "no newline at the end", content: "A=1", want: []string{"A=1"}},
+		{name: "empty file", content: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEnvFile(t, tt.content)
+			got, err := ReadEnvFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadEnvFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadEnvFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "no equal sign", content: "A=1\nB\n", want: ":2: Need KEY=VALUE."},
+		{name: "no name", content: "=1\n", want: ":1: Need KEY=VALUE."},
+		{name: "unterminated double quotes", content: `A="a` + "\n", want: ":1: Invalid quoted value."},
+		{name: "unterminated single quotes", content: `A='a` + "\n", want: ":1: Invalid quoted value."},
+		{name: "text after quotes", content: `A="a" b` + "\n", want: ":1: Invalid quoted value."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeEnvFile(t, tt.content)
+			_, err := ReadEnvFile(path)
+			if err == nil {
+				t.Fatal("ReadEnvFile() succeeded")
+			}
+			if want := path + tt.want; err.Error() != want {
+				t.Errorf("ReadEnvFile() error = %q, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestReadEnvFileNotExist(t *testing.T) {
+	_, err := ReadEnvFile(filepath.Join(t.TempDir(), "missing.env"))
+	if !os.IsNotExist(err) {
+		t.Errorf("ReadEnvFile() error = %v, want not exist", err)
+	}
+}
+
+func writeEnvFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,12 @@
+package util
+
+import "fmt"
+
+// ExitError reports the exit code of a remote command, which should become the exit code of ecsk.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}